@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// archiveDir is the directory in the cache holding the previous databases
+// of the repositories in archive mode. Like the quarantine, it can't collide
+// with an architecture.
+const archiveDir = ".archive"
+
+// Archive controls the point-in-time archive of the repositories
+type Archive struct {
+	// Enabled keeps the previous databases and all versions of the cached
+	// packets so past states of the repositories can be served
+	Enabled bool
+	// Retention is the time previous databases are kept after they were
+	// replaced, 0 keeps them forever
+	Retention time.Duration
+}
+
+// archivedDB is a previous database of a repository
+type archivedDB struct {
+	filename string
+	// the database was live from this time on until the next one
+	validFrom time.Time
+}
+
+// SetArchive sets the settings of the archive
+func (c *Cache) SetArchive(a Archive) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.archive = a
+}
+
+// Archive returns the settings of the archive
+func (c *Cache) Archive() Archive {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	return c.archive
+}
+
+// archivePath returns the directory of the previous databases of a repository
+func (c *Cache) archivePath(repo *database.Repository) string {
+	return filepath.Join(c.directory, archiveDir, repo.Arch, repo.Name)
+}
+
+// archiveDB moves the live database of the repository together with its
+// signature to the archive before it is replaced. It returns the archived
+// file, empty if nothing was archived because the archive is disabled.
+// c.repoMu has to be held.
+func (c *Cache) archiveDB(repo *database.Repository) string {
+	if !c.Archive().Enabled || !c.hasArtifact(repo, database.DB) {
+		return ""
+	}
+
+	// The modification time is the time the database was published
+	file := c.repoPath(repo, database.DB)
+	stat, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+
+	target := filepath.Join(c.archivePath(repo), strconv.FormatInt(stat.ModTime().Unix(), 10)+".db")
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err == nil {
+		err = os.Rename(file, target)
+	}
+	if err != nil {
+		log.Println(errors.Wrapf(err, "Error archiving database of %s", repo))
+		return ""
+	}
+
+	os.Remove(target + ".sig")
+	if err := os.Rename(file+".sig", target+".sig"); err != nil && !os.IsNotExist(err) {
+		log.Println(errors.Wrapf(err, "Error archiving signature of %s", repo))
+	}
+	c.addArchived(*repo, c.indexes[*repo])
+	return target
+}
+
+// unarchiveDB moves a database archived by archiveDB back to be the live
+// one after replacing it failed, c.repoMu has to be held
+func (c *Cache) unarchiveDB(repo *database.Repository, archived string) {
+	file := c.repoPath(repo, database.DB)
+	if err := os.Rename(archived, file); err != nil {
+		log.Println(errors.Wrapf(err, "Error restoring database of %s", repo))
+		return
+	}
+
+	os.Remove(file + ".sig")
+	if err := os.Rename(archived+".sig", file+".sig"); err != nil && !os.IsNotExist(err) {
+		log.Println(errors.Wrapf(err, "Error restoring signature of %s", repo))
+	}
+}
+
+// addArchived adds the packets of the given index to the ones referenced by
+// the archived databases of the repository, c.repoMu has to be held
+func (c *Cache) addArchived(repo database.Repository, index *database.Index) {
+	if c.archived[repo] == nil {
+		c.archived[repo] = make(map[string]struct{})
+	}
+	for _, info := range index.All() {
+		c.archived[repo][info.Filename] = struct{}{}
+	}
+}
+
+// isArchived reports whether one of the archived databases of the repository
+// references the packet, c.repoMu has to be held
+func (c *Cache) isArchived(repo *database.Repository, filename string) bool {
+	_, ok := c.archived[*repo][filename]
+	return ok
+}
+
+// loadArchived reads the archived databases of the given repository left
+// from a previous run, c.repoMu has to be held
+func (c *Cache) loadArchived(repo database.Repository) {
+	for _, db := range c.archivedDBs(&repo) {
+		index, err := database.IndexFromFile(db.filename)
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Error reading archived database %s", db.filename))
+			continue
+		}
+		c.addArchived(repo, index)
+	}
+}
+
+// archivedDBs lists the previous databases of the repository sorted by the
+// time they went live, c.repoMu has to be held
+func (c *Cache) archivedDBs(repo *database.Repository) []archivedDB {
+	files, err := ioutil.ReadDir(c.archivePath(repo))
+	if err != nil {
+		return nil
+	}
+
+	dbs := make([]archivedDB, 0, len(files))
+	for _, f := range files {
+		unix, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".db"), 10, 64)
+		if err != nil || !strings.HasSuffix(f.Name(), ".db") {
+			continue
+		}
+		dbs = append(dbs, archivedDB{
+			filename:  filepath.Join(c.archivePath(repo), f.Name()),
+			validFrom: time.Unix(unix, 0),
+		})
+	}
+
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].validFrom.Before(dbs[j].validFrom)
+	})
+	return dbs
+}
+
+// GetArchivedDBFile returns the database of the repository that was live
+// before the given time together with its signature
+func (c *Cache) GetArchivedDBFile(repo *database.Repository, before time.Time) (*DBFile, error) {
+	c.repoMu.Lock()
+	defer c.repoMu.Unlock()
+
+	dbs := c.archivedDBs(repo)
+	if c.hasArtifact(repo, database.DB) {
+		if stat, err := os.Stat(c.repoPath(repo, database.DB)); err == nil {
+			dbs = append(dbs, archivedDB{c.repoPath(repo, database.DB), stat.ModTime()})
+		}
+	}
+
+	var found *archivedDB
+	for i := range dbs {
+		if dbs[i].validFrom.Before(before) {
+			found = &dbs[i]
+		}
+	}
+	if found == nil {
+		return nil, errors.Wrap(ErrNotFound, "No database archived for that time")
+	}
+
+	file, err := os.Open(found.filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening archived database")
+	}
+
+	dbFile := &DBFile{File: file, ModTime: found.validFrom}
+	sig, err := os.Open(found.filename + ".sig")
+	if err == nil {
+		dbFile.Signature = sig
+	} else if !os.IsNotExist(err) {
+		file.Close()
+		return nil, errors.Wrap(err, "Error opening archived signature")
+	}
+
+	return dbFile, nil
+}
+
+// pruneArchive removes the previous databases replaced longer than the
+// retention ago and afterwards the old versions of packets none of the
+// remaining databases references
+func (c *Cache) pruneArchive(now time.Time) {
+	archive := c.Archive()
+	if !archive.Enabled {
+		return
+	}
+
+	// Remove the expired databases and remember the remaining ones
+	c.repoMu.Lock()
+	remaining := make(map[database.Repository][]string)
+	indexes := make(map[database.Repository][]*database.Index)
+	for repo := range c.repos {
+		index := c.indexes[repo]
+		if index == nil {
+			continue
+		}
+		indexes[repo] = []*database.Index{index}
+		if staged := c.staged[repo]; staged != nil {
+			indexes[repo] = append(indexes[repo], staged)
+		}
+
+		dbs := c.archivedDBs(&repo)
+		for i, db := range dbs {
+			replaced := now
+			if i+1 < len(dbs) {
+				replaced = dbs[i+1].validFrom
+			} else if stat, err := os.Stat(c.repoPath(&repo, database.DB)); err == nil {
+				replaced = stat.ModTime()
+			}
+
+			if archive.Retention > 0 && now.Sub(replaced) > archive.Retention {
+				log.Println("Removing archived database", filepath.Join(repo.Arch, repo.Name), db.validFrom.UTC())
+				os.Remove(db.filename)
+				os.Remove(db.filename + ".sig")
+				continue
+			}
+			remaining[repo] = append(remaining[repo], db.filename)
+		}
+	}
+	c.repoMu.Unlock()
+
+	// Parsing the databases may take a while, no lock is needed for it
+	archived := make(map[database.Repository][]*database.Index)
+	for repo, filenames := range remaining {
+		for _, filename := range filenames {
+			index, err := database.IndexFromFile(filename)
+			if err != nil {
+				// Unreadable databases can't protect any packets
+				log.Println(errors.Wrapf(err, "Error reading archived database %s", filename))
+				continue
+			}
+			indexes[repo] = append(indexes[repo], index)
+			archived[repo] = append(archived[repo], index)
+		}
+	}
+
+	// Only the packets of the remaining databases are served in old versions
+	c.repoMu.Lock()
+	for repo := range indexes {
+		delete(c.archived, repo)
+		for _, index := range archived[repo] {
+			c.addArchived(repo, index)
+		}
+	}
+	c.repoMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for repo, repoIndexes := range indexes {
+		outdated := make([]*packet.Packet, 0)
+		for _, p := range c.packets[repo] {
+			referenced := false
+			for _, index := range repoIndexes {
+				if index.ByFilename(p.Filename()) != nil {
+					referenced = true
+					break
+				}
+			}
+			if referenced {
+				continue
+			}
+
+			for _, other := range c.packets[repo].FindOtherVersions(p) {
+				if packet.CompareVersions(p.Version, other.Version) < 0 {
+					outdated = append(outdated, p)
+					break
+				}
+			}
+		}
+
+		for _, p := range outdated {
+			if err := c.removePacket(p, repo); err != nil {
+				log.Println(errors.Wrap(err, "Error removing old packet"))
+				continue
+			}
+			log.Println("Removed old packet", filepath.Join(repo.Arch, repo.Name, p.Filename()))
+		}
+	}
+}
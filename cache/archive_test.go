@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const newFilename = "linux-5.3.arch1-1-x86_64.pkg.tar.xz"
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	var db atomic.Value
+	var modTime atomic.Value
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + _repo + ".db":
+			http.ServeContent(w, r, r.URL.Path, modTime.Load().(time.Time), bytes.NewReader(db.Load().([]byte)))
+		case "/" + _filename, "/" + newFilename:
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(_content))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer mirror.Close()
+
+	publish := func(filename string, published time.Time) []byte {
+		writeTestDB(t, dir, repo, _content, filename)
+		b, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo+".db"))
+		assert.NoError(t, err)
+		db.Store(b)
+		modTime.Store(published)
+		return b
+	}
+	update := func(c *Cache) {
+		res := make(chan error)
+		assert.NoError(t, c.RefreshRepo(&repo, res))
+		assert.NoError(t, <-res)
+	}
+	archivedDB := func(c *Cache, before time.Time) ([]byte, error) {
+		f, err := c.GetArchivedDBFile(&repo, before)
+		if err != nil {
+			return nil, err
+		}
+		data, _ := readDBFile(t, f)
+		return data, nil
+	}
+
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL)})
+	assert.NoError(t, err)
+	c.SetArchive(Archive{Enabled: true})
+
+	day1 := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	day3 := day1.AddDate(0, 0, 2)
+	oldDB := publish(_filename, day1)
+	update(c)
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+	assert.NoError(t, c.backgroundDownload(&download{P: *p, R: repo}))
+
+	// The replaced database is archived and the old packet is kept
+	newDB := publish(newFilename, day3)
+	update(c)
+	waitCached(t, c, repo, newFilename)
+	c.mu.Lock()
+	assert.NotNil(t, c.packets[repo].ByFilename(_filename))
+	c.mu.Unlock()
+
+	data, err := archivedDB(c, day1.AddDate(0, 0, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, oldDB, data)
+	data, err = archivedDB(c, day3.AddDate(0, 0, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, newDB, data)
+	_, err = archivedDB(c, day1)
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+
+	// Packets referenced by an archived database are kept
+	c.pruneArchive(day3.AddDate(0, 0, 2))
+	c.mu.Lock()
+	assert.NotNil(t, c.packets[repo].ByFilename(_filename))
+	c.mu.Unlock()
+
+	// Old versions are only downloaded again for an archived database
+	c.mu.Lock()
+	assert.NoError(t, c.removePacket(c.packets[repo].ByFilename(_filename), repo))
+	c.mu.Unlock()
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, r)
+		assert.NoError(t, err)
+		r.Close()
+	}
+	waitCached(t, c, repo, _filename)
+	older, err := packet.FromFilename("linux-5.1.arch1-1-x86_64.pkg.tar.xz")
+	assert.NoError(t, err)
+	_, err = c.GetPacket(context.Background(), older, &repo)
+	assert.Equal(t, ErrOutdated, errors.Cause(err))
+
+	// Expired databases are removed together with their old packets
+	c.SetArchive(Archive{Enabled: true, Retention: 24 * time.Hour})
+	c.pruneArchive(day3.AddDate(0, 0, 2))
+	_, err = archivedDB(c, day1.AddDate(0, 0, 1))
+	assert.Equal(t, ErrNotFound, errors.Cause(err))
+	c.mu.Lock()
+	assert.Nil(t, c.packets[repo].ByFilename(_filename))
+	assert.NotNil(t, c.packets[repo].ByFilename(newFilename))
+	c.mu.Unlock()
+
+	// Wait for the background downloads before the directory is removed
+	assert.NoError(t, c.Close(context.Background()))
+}
@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"context"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,23 +13,56 @@ import (
 	"github.com/veecue/pacman-smartmirror/database"
 	"github.com/veecue/pacman-smartmirror/mirrorlist"
 	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/pgp"
 )
 
 // Cache is a cache that caches packages in the filesystem.
 // The currently only implementation at the moment is storing
 // it in a directory in the filesystem.
 type Cache struct {
+	// atomically accessed, has to be at the beginning of the struct
+	// for proper alignment on 32 bit machines
+	evictions int64
+	bgQueued  int64
+
 	directory     string
 	mirrors       mirrorlist.Mirrorlist
+	routes        []Route
+	health        *mirrorlist.Health
 	packets       map[database.Repository]packet.Set
 	downloads     map[string]*ongoingDownload
-	repos         map[database.Repository]struct{}
-	repoDownloads map[database.Repository]struct{}
+	repos         map[database.Repository]artifactSet
+	indexes       map[database.Repository]*database.Index
+	staged        map[database.Repository]*database.Index
+	archived      map[database.Repository]map[string]struct{}
+	repoDownloads map[repoFile]struct{}
+	usage         map[string]*usage
+	size          int64
+	limits        Limits
 	mu            sync.Mutex
 	repoMu        sync.Mutex
 	bgDownload    sync.Mutex
+	metrics       *cacheMetrics
+	policies      map[string]Policy
+	upstream      Upstream
+	keyring       *pgp.Keyring
+	archive       Archive
+	stopWatch     context.CancelFunc
+	settingsMu    sync.RWMutex
+
+	// set once the cache is closing, c.mu and c.repoMu have to be held
+	// for writing, one of them for reading
+	closed bool
+	// cancelled when the cache is closed, all background work uses it
+	ctx    context.Context
+	cancel context.CancelFunc
+	// tracks running downloads
+	wg sync.WaitGroup
 }
 
+// ErrOutdated is returned when requesting a packet older than the cached one
+var ErrOutdated = errors.New("Newer version available")
+
 // ReadSeekCloser implements io.ReadSeeker and io.Closer
 type ReadSeekCloser interface {
 	io.ReadSeeker
@@ -40,11 +75,19 @@ func New(directory string, mirrors mirrorlist.Mirrorlist) (*Cache, error) {
 		directory:     directory,
 		packets:       make(map[database.Repository]packet.Set),
 		mirrors:       mirrors,
+		health:        mirrorlist.NewHealth(),
 		downloads:     make(map[string]*ongoingDownload),
-		repos:         make(map[database.Repository]struct{}),
-		repoDownloads: make(map[database.Repository]struct{}),
+		repos:         make(map[database.Repository]artifactSet),
+		indexes:       make(map[database.Repository]*database.Index),
+		staged:        make(map[database.Repository]*database.Index),
+		archived:      make(map[database.Repository]map[string]struct{}),
+		repoDownloads: make(map[repoFile]struct{}),
+		usage:         make(map[string]*usage),
+		upstream:      DefaultUpstream(),
 	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
+	c.initMetrics()
 	err := c.init()
 	if err != nil {
 		return nil, err
@@ -57,6 +100,7 @@ func New(directory string, mirrors mirrorlist.Mirrorlist) (*Cache, error) {
 func (c *Cache) init() error {
 	// Migrate packages stored directly in the dir to their proper repo location
 	migrationList := make([]*packet.Packet, 0)
+	partials := make([]*download, 0)
 
 	err := filepath.Walk(c.directory, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -64,6 +108,9 @@ func (c *Cache) init() error {
 		}
 
 		if info.IsDir() {
+			if path == filepath.Join(c.directory, quarantineDir) || path == filepath.Join(c.directory, archiveDir) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
@@ -72,11 +119,26 @@ func (c *Cache) init() error {
 			return err
 		}
 
+		parts := strings.Split(rel, string(filepath.Separator))
+
 		if strings.HasSuffix(rel, ".part") {
+			// Keep partially downloaded packets so their download can be resumed
+			if len(parts) == 3 {
+				if p, err := packet.FromFilename(strings.TrimSuffix(parts[2], ".part")); err == nil {
+					partials = append(partials, &download{
+						P: *p,
+						R: database.Repository{Arch: parts[0], Name: parts[1]},
+					})
+					return nil
+				}
+			}
 			return os.Remove(path)
 		}
 
-		parts := strings.Split(rel, string(filepath.Separator))
+		if strings.HasSuffix(rel, ".sig") {
+			// Signatures are handled together with their packets
+			return nil
+		}
 
 		if len(parts) == 1 {
 			filename := parts[0]
@@ -89,17 +151,19 @@ func (c *Cache) init() error {
 		}
 
 		if len(parts) == 2 {
-			arch := parts[0]
-			db := parts[1]
-
-			if !strings.HasSuffix(db, ".db") {
+			name, artifact, ok := database.ParseArtifact(parts[1])
+			if !ok {
 				return nil
 			}
 
-			c.repos[database.Repository{
-				Name: strings.TrimSuffix(db, ".db"),
-				Arch: arch,
-			}] = struct{}{}
+			repo := database.Repository{
+				Name: name,
+				Arch: parts[0],
+			}
+			if c.repos[repo] == nil {
+				c.repos[repo] = make(artifactSet)
+			}
+			c.repos[repo][artifact] = struct{}{}
 			return err
 		}
 
@@ -120,6 +184,11 @@ func (c *Cache) init() error {
 			}
 
 			c.packets[repo].Insert(p)
+			size := info.Size()
+			if sig, err := os.Stat(path + ".sig"); err == nil {
+				size += sig.Size()
+			}
+			c.track(p, repo, size, info.ModTime())
 		}
 
 		return nil
@@ -129,21 +198,65 @@ func (c *Cache) init() error {
 		return errors.Wrap(err, "Error reading cache directory")
 	}
 
+	for repo := range c.repos {
+		if !c.hasArtifact(&repo, database.DB) {
+			continue
+		}
+
+		file := c.repoPath(&repo, database.DB)
+		index, err := database.IndexFromFile(file)
+		if err != nil {
+			// Download the database again when it's used the next time
+			log.Println("Removing invalid database", repo, err)
+			os.Remove(file)
+			delete(c.repos[repo], database.DB)
+			if len(c.repos[repo]) == 0 {
+				delete(c.repos, repo)
+			}
+			continue
+		}
+
+		c.indexes[repo] = index
+		c.loadStaged(repo)
+		c.loadArchived(repo)
+	}
+
+	// Partial downloads can only be resumed if they can be verified afterwards
+	for _, d := range partials {
+		if !verifiable(c.indexes[d.R].ByFilename(d.P.Filename())) {
+			os.Remove(filepath.Join(c.directory, d.Path()+".part"))
+		}
+	}
+
 	return errors.Wrap(c.migrate(migrationList), "Error migrating")
 }
 
 // GetPacket serves a packet either from the cache or proxies it from a mirror
-// Returns an io.ReadSeaker with access to the packet data
-func (c *Cache) GetPacket(p *packet.Packet, repo *database.Repository) (ReadSeekCloser, error) {
+// Returns an io.ReadSeaker with access to the packet data. Reading data that
+// is still being downloaded fails once ctx is done.
+func (c *Cache) GetPacket(ctx context.Context, p *packet.Packet, repo *database.Repository) (ReadSeekCloser, error) {
+	// Older versions are still served while a new database is staged as the
+	// live one references them, the archive serves the ones its previous
+	// databases reference.
+	c.repoMu.Lock()
+	keepOld := c.isStaging(repo) || (c.Archive().Enabled && c.isArchived(repo, p.Filename()))
+	c.repoMu.Unlock()
+	info, _ := c.lookupInfo(&download{P: *p, R: *repo})
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	// Download the packet's repo in the backround if we don't have it yet
-	go c.addRepo(repo, nil)
+	go c.addRepo(repo, database.DB, nil)
 
 	// First: check if the packet is currently being downloaded
 	if download, ok := c.downloads[(&download{P: *p, R: *repo}).Path()]; ok && download.Dl.P == *p {
-		return download.GetReader()
+		c.metrics.requests.WithLabelValues("miss").Inc()
+		r, err := download.GetReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return c.countServed(r, "upstream"), nil
 	}
 
 	// Second: check if the packet already is available in cache
@@ -153,23 +266,63 @@ func (c *Cache) GetPacket(p *packet.Packet, repo *database.Repository) (ReadSeek
 			return nil, errors.Wrap(err, "Error opening cached packet file")
 		}
 
-		return f, nil
+		c.touch(cachedP, *repo)
+		c.metrics.requests.WithLabelValues("hit").Inc()
+		return c.countServed(f, "cache"), nil
 	}
 
 	// Bail out if newer package version exists
 	for _, cachedP := range c.packets[*repo].FindOtherVersions(p) {
 		versionDiff := packet.CompareVersions(p.Version, cachedP.Version)
-		if versionDiff < 0 {
-			return nil, errors.New("Newer version available")
+		if versionDiff < 0 && !keepOld {
+			return nil, ErrOutdated
 		}
 	}
 
 	// Third: download packet to cache
-	download, err := c.startDownload(&download{*p, *repo, nil})
+	c.metrics.requests.WithLabelValues("miss").Inc()
+	download, err := c.startDownload(&download{*p, *repo, nil}, info)
 	if err != nil {
 		return nil, errors.Wrap(err, "Error downloading the packet")
 	}
-	return download.GetReader()
+
+	r, err := download.GetReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.countServed(r, "upstream"), nil
+}
+
+// Close stops all background work of the cache: no new downloads are started
+// and the running downloads are waited for until ctx is done. Remaining
+// downloads are interrupted afterwards, their partial files are kept so they
+// can be resumed after a restart. Finally, the access times of the cached
+// packets are persisted.
+func (c *Cache) Close(ctx context.Context) error {
+	// Downloads are only started with the locks held, so none is started
+	// after closing
+	c.mu.Lock()
+	c.repoMu.Lock()
+	c.closed = true
+	c.repoMu.Unlock()
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Interrupting", len(c.Downloads()), "downloads")
+		c.cancel()
+		<-done
+	}
+	c.cancel()
+
+	return c.persistUsage()
 }
 
 // AddPacket downloads the given packet in the background when possible and
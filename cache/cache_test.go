@@ -2,11 +2,15 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,6 +45,10 @@ func getSize(t *testing.T, s io.Seeker) int {
 func TestSimple(t *testing.T) {
 	var calls int32
 	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
 		if atomic.AddInt32(&calls, 1) > 1 {
 			assert.Fail(t, "Server called to often")
 		}
@@ -88,13 +96,13 @@ func TestSimple(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			r, err := c.GetPacket(p, &database.Repository{
+			r, err := c.GetPacket(context.Background(), p, &database.Repository{
 				Name: _repo,
 				Arch: _arch,
 			})
 			assert.NoError(t, err)
 			if err != nil {
-				t.FailNow()
+				return
 			}
 			assert.Equal(t, len(_content), getSize(t, r))
 			var b bytes.Buffer
@@ -107,4 +115,64 @@ func TestSimple(t *testing.T) {
 		}
 	}
 	wg.Wait()
+
+	// Requests arriving after the download finished are cache hits
+	text := metricsText(t, c)
+	requests := metricValue(text, `smartmirror_packet_requests_total{result="miss"}`) +
+		metricValue(text, `smartmirror_packet_requests_total{result="hit"}`)
+	assert.Equal(t, float64(50), requests)
+	served := metricValue(text, `smartmirror_served_bytes_total{source="upstream"}`) +
+		metricValue(text, `smartmirror_served_bytes_total{source="cache"}`)
+	assert.Equal(t, float64(50*len(_content)), served)
+}
+
+// metricsText returns all metrics of the cache in the Prometheus text format
+func metricsText(t *testing.T, c *Cache) string {
+	w := httptest.NewRecorder()
+	c.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	return w.Body.String()
+}
+
+// metricValue returns the value of a series in the Prometheus text format,
+// 0 if it is missing
+func metricValue(text, series string) float64 {
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			return v
+		}
+	}
+
+	return 0
+}
+
+func TestCompressions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repoDir := filepath.Join(dir, _arch, _repo)
+	assert.NoError(t, os.MkdirAll(repoDir, 0755))
+	filenames := make([]string, 0)
+	for i, compression := range append(packet.Compressions, "") {
+		p := packet.Packet{Name: fmt.Sprintf("packet%d", i), Version: "1.0-1", Arch: _arch, Compression: compression}
+		filenames = append(filenames, p.Filename())
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(repoDir, p.Filename()), []byte(_content), 0644))
+	}
+
+	// Packets of all compressions are found in the cache and served
+	c, err := New(dir, mirrorlist.Mirrorlist{})
+	assert.NoError(t, err)
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	for _, filename := range filenames {
+		p, err := packet.FromFilename(filename)
+		assert.NoError(t, err)
+		r, err := c.GetPacket(context.Background(), p, &repo)
+		assert.NoError(t, err, filename)
+		if err == nil {
+			assert.Equal(t, len(_content), getSize(t, r))
+			r.Close()
+		}
+	}
 }
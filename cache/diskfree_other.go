@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package cache
+
+import "github.com/pkg/errors"
+
+// freeSpace is not supported on this platform
+func freeSpace(directory string) (int64, error) {
+	return 0, errors.New("Checking free disk space is not supported on this platform")
+}
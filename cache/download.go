@@ -1,18 +1,58 @@
 package cache
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
 	"github.com/veecue/pacman-smartmirror/packet"
 )
 
+// maxResumes is the number of times an interrupted download is resumed
+// before giving up
+const maxResumes = 5
+
+// States of an ongoingDownload. Complete, failed and cancelled downloads
+// never change their state again.
+const (
+	downloadRunning int32 = iota
+	downloadVerified
+	downloadComplete
+	downloadFailed
+	downloadCancelled
+)
+
+// ErrCancelled is the error of downloads that have been cancelled
+var ErrCancelled = errors.New("Download cancelled")
+
+// ErrNotFound is returned if all mirrors reported a file as missing
+var ErrNotFound = errors.New("Not found on any mirror")
+
+// ErrClosed is returned if a download is requested after the cache was closed
+var ErrClosed = errors.New("Cache closed")
+
+// notFoundOr returns ErrNotFound if all of the mirrors reported a file as
+// missing, err otherwise
+func notFoundOr(missing int, mirrors mirrorlist.Mirrorlist, err error) error {
+	if missing > 0 && missing == len(mirrors) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
 // ongoingDownload stores neccessary information about an ongoing download to use its data or resume it
 type ongoingDownload struct {
 	// force alignment of atomically accessed "written" by putting it at the beginning
@@ -21,8 +61,64 @@ type ongoingDownload struct {
 
 	Dl       download
 	filesize int64
+	state    int32
 
 	filename string
+	// the mirror the packet is downloaded from
+	mirror mirrorlist.Mirror
+	// mirrors to retry the download from if the downloaded file is invalid
+	fallback mirrorlist.Mirrorlist
+	// detached signature fetched together with the packet, nil if unavailable
+	signature []byte
+	// metadata from the repository database, nil if unavailable
+	info *database.PackageInfo
+	// ETag or Last-Modified value of the download to validate resumes with
+	validator string
+
+	// cancels the requests of the download
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// closed and replaced whenever data is written or the state changes
+	changed chan struct{}
+	// the reason of the failure once the state is downloadFailed
+	err error
+	mu  sync.Mutex
+}
+
+// notify wakes up all readers waiting for a change of the download
+func (dl *ongoingDownload) notify() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	close(dl.changed)
+	dl.changed = make(chan struct{})
+}
+
+// changes returns a channel that is closed on the next change of the download
+func (dl *ongoingDownload) changes() <-chan struct{} {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	return dl.changed
+}
+
+// finish sets the final state of the download and wakes up all readers
+func (dl *ongoingDownload) finish(state int32, err error) {
+	dl.mu.Lock()
+	dl.err = err
+	atomic.StoreInt32(&dl.state, state)
+	dl.mu.Unlock()
+
+	dl.notify()
+}
+
+// failure returns the reason the download failed
+func (dl *ongoingDownload) failure() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	return dl.err
 }
 
 type download struct {
@@ -46,55 +142,117 @@ func (d *download) DirPath() string {
 }
 
 // GetReader returns a ReadSeeker that will read the already downloaded content from the file
-// and wait for any undownloaded content (for serving to the client)
-func (dl *ongoingDownload) GetReader() (ReadSeekCloser, error) {
+// and wait for any undownloaded content (for serving to the client). Waiting
+// fails once ctx is done.
+func (dl *ongoingDownload) GetReader(ctx context.Context) (ReadSeekCloser, error) {
 	r, err := os.Open(dl.filename)
 	if err != nil {
 		return nil, err
 	}
 	return &dynamicLimitReaderWithSize{
-		R:     r,
-		Size:  dl.filesize,
-		Limit: &dl.written,
+		R:    r,
+		Size: dl.filesize,
+		Dl:   dl,
+		Ctx:  ctx,
 	}, nil
 }
 
 // startDownload will start downloading the given packet from a mirror on the mirrorlist in the
-// background and add it to the cache once finished.
+// background and add it to the cache once finished. info is the packet's entry in the repository
+// database or nil, it has to be looked up with lookupInfo before c.mu is taken.
 //
 // Returns info about the ongoing download so it can be served to the client.
 // When the returned error is nil, the channel will receive a follow-up error (can be nil)
 // exactly once
-func (c *Cache) startDownload(d *download) (*ongoingDownload, error) {
-	for _, mirror := range c.mirrors {
+func (c *Cache) startDownload(d *download, info *database.PackageInfo) (*ongoingDownload, error) {
+	return c.startDownloadFrom(d, info, c.rankedMirrors(&d.R))
+}
+
+// startDownloadFrom works like startDownload but only tries the given mirrors.
+// If the downloaded file fails verification, the download is retried with
+// the mirrors following the one that was used.
+//
+// Partial files left by an earlier download are resumed if the result can
+// be verified against the repository database.
+func (c *Cache) startDownloadFrom(d *download, info *database.PackageInfo, mirrors mirrorlist.Mirrorlist) (*ongoingDownload, error) {
+	filename := filepath.Join(c.directory, d.Path()+".part")
+
+	var offset int64
+	if stat, err := os.Stat(filename); err == nil && verifiable(info) && stat.Size() < info.CSize {
+		offset = stat.Size()
+	}
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	missing := 0
+	for i, mirror := range mirrors {
 		req, _ := http.NewRequest("GET", mirror.PacketURL(&d.P, &d.R), nil)
-		req.Header.Set("User-Agent", "pacman-smartmirror/0.0")
-		resp, err := http.DefaultClient.Do(req)
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		resp, err := c.do(ctx, req, mirror)
 		if err != nil {
 			//TODO: log?
 			continue
 		}
 
-		if resp.StatusCode != 200 {
+		var start, filesize int64
+		switch resp.StatusCode {
+		case 200:
+			filesize = resp.ContentLength
+		case 206:
+			var ok bool
+			start, filesize, ok = contentRange(resp)
+			if !ok || start != offset {
+				resp.Body.Close()
+				continue
+			}
+			log.Println("Resuming download of", d.Path(), "at byte", start)
+		case 404:
+			missing++
+			resp.Body.Close()
+			continue
+		default:
+			resp.Body.Close()
 			continue
 		}
 
 		// seems to work, use this mirror
 		dl := &ongoingDownload{
-			Dl:       *d,
-			filesize: resp.ContentLength,
-			filename: filepath.Join(c.directory, d.Path()+".part"),
+			written:   start,
+			Dl:        *d,
+			filesize:  filesize,
+			filename:  filename,
+			mirror:    mirror,
+			fallback:  mirrors[i+1:],
+			info:      info,
+			validator: validator(resp),
+			ctx:       ctx,
+			cancel:    cancel,
+			changed:   make(chan struct{}),
 		}
 
 		// create the directory to store the file in if neccessary
 		err = os.MkdirAll(filepath.Join(c.directory, d.DirPath()), 0755)
 		if err != nil && !os.IsExist(err) {
+			resp.Body.Close()
+			cancel()
 			return nil, errors.Wrapf(err, "Error creating dir %s", d.DirPath())
 		}
 
-		// create the temporary file to store the download
-		f, err := os.Create(dl.filename)
+		// create or continue the temporary file to store the download
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if start > 0 {
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(dl.filename, flags, 0644)
 		if err != nil {
+			resp.Body.Close()
+			cancel()
 			return nil, errors.Wrap(err, "Error creating cache file")
 		}
 
@@ -102,66 +260,236 @@ func (c *Cache) startDownload(d *download) (*ongoingDownload, error) {
 		c.downloads[dl.Dl.Path()] = dl
 
 		// do actual download in the background
-		go func() {
-			w, err := io.Copy(&countWriter{f, &dl.written}, resp.Body)
-			f.Close()
+		c.wg.Add(1)
+		go c.runDownload(dl, f, resp.Body)
+
+		// Return info about ongoing download so it can be served right away
+		return dl, nil
+	}
+
+	cancel()
+	return nil, notFoundOr(missing, mirrors, errors.New("Packet could not be downloaded from any mirror"))
+}
 
-			c.mu.Lock()
-			defer c.mu.Unlock()
+// runDownload copies body to the partial file f, resuming the download if it
+// gets interrupted. Afterwards, the file is verified and finalized.
+func (c *Cache) runDownload(dl *ongoingDownload, f *os.File, body io.ReadCloser) {
+	defer c.wg.Done()
+	hash := sha256.New()
 
-			//TODO: better error handling (#9)
+	// Bytes from a resumed partial file have to be hashed as well
+	var err error
+	if offset := atomic.LoadInt64(&dl.written); offset > 0 {
+		err = hashPrefix(hash, dl.filename, offset)
+	}
+
+	w := &countWriter{io.MultiWriter(f, hash), dl}
+	for resumes := 0; err == nil; resumes++ {
+		var n int64
+		start := time.Now()
+		n, err = io.Copy(w, body)
+		body.Close()
+		c.health.RecordTransfer(dl.mirror, n, time.Since(start))
+
+		if err == nil && atomic.LoadInt64(&dl.written) < dl.filesize {
+			err = errors.New("Too few bytes read while downloading to cache")
+		}
+
+		if err == nil {
+			break
+		}
+
+		if dl.ctx.Err() != nil {
+			err = ErrCancelled
+			break
+		}
+
+		c.mirrorFailed(dl.mirror, err)
+		if resumes >= maxResumes {
+			break
+		}
+
+		log.Println("Download of", dl.Dl.Path(), "interrupted:", err)
+		var resumeErr error
+		body, resumeErr = c.resumeDownload(dl)
+		if resumeErr != nil {
+			log.Println(resumeErr)
+			break
+		}
+
+		err = nil
+	}
+	f.Close()
+
+	var mismatch bool
+	if err == nil {
+		err = c.verifyDownload(&dl.Dl, atomic.LoadInt64(&dl.written), hex.EncodeToString(hash.Sum(nil)))
+		if err != nil {
+			mismatch = true
+			c.mirrorFailed(dl.mirror, err)
+		}
+	}
+
+	// With a keyring, readers only see the end of the packet once its
+	// signature is verified
+	var untrusted bool
+	if keyring := c.getKeyring(); err == nil && keyring != nil {
+		dl.signature, _ = c.fetchSignature(dl.ctx, &dl.Dl, append(mirrorlist.Mirrorlist{dl.mirror}, dl.fallback...))
+		err = verifyPacket(keyring, dl)
+		if dl.ctx.Err() != nil {
+			err = ErrCancelled
+		} else if err != nil {
+			untrusted = true
+			c.mirrorFailed(dl.mirror, err)
+		}
+	}
+
+	if err == nil {
+		dl.finish(downloadVerified, nil)
+		if dl.signature == nil {
+			dl.signature, err = c.fetchSignature(dl.ctx, &dl.Dl, append(mirrorlist.Mirrorlist{dl.mirror}, dl.fallback...))
 			if err != nil {
-				err = errors.Wrap(err, "Error downloading to local cache")
-				log.Println(err)
-				os.Remove(dl.filename)
-				delete(c.downloads, dl.Dl.Path())
-				dl.Dl.Callback(err)
-				return
+				log.Println("No signature for", dl.Dl.Path()+":", err)
 			}
+		}
+		c.wg.Add(1)
+		go c.finalizeDownload(dl, nil)
+		return
+	}
 
-			if w < dl.filesize {
-				err = errors.New("Too few bytes read while downloading to cache")
-				log.Println(err)
-				os.Remove(dl.filename)
-				delete(c.downloads, dl.Dl.Path())
-				dl.Dl.Callback(err)
-				return
-			}
+	dl.cancel()
+	if err == ErrCancelled {
+		log.Println("Download of", dl.Dl.Path(), "cancelled")
+		dl.finish(downloadCancelled, err)
+	} else {
+		//TODO: better error handling (#9)
+		err = errors.Wrap(err, "Error downloading to local cache")
+		log.Println(err)
+		dl.finish(downloadFailed, err)
+	}
 
-			go c.finalizeDownload(dl, err)
-		}()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		// Return info about ongoing download so it can be served right away
-		return dl, nil
+	if err == ErrCancelled && c.ctx.Err() != nil {
+		// Interrupted by closing the cache, keep the partial file so the
+		// download can be resumed after a restart
+		log.Println("Keeping partial download", dl.filename)
+	} else if untrusted {
+		c.quarantine(dl.filename, dl.Dl.Path(), dl.signature, "packet")
+	} else {
+		os.Remove(dl.filename)
+	}
+	delete(c.downloads, dl.Dl.Path())
+
+	if mismatch && len(dl.fallback) > 0 {
+		log.Println("Retrying", dl.Dl.Path(), "from the next mirror")
+		_, err = c.startDownloadFrom(&dl.Dl, dl.info, dl.fallback)
+		if err == nil {
+			// The new download will report its result
+			return
+		}
+	}
+
+	dl.Dl.Callback(err)
+}
+
+// resumeDownload requests the rest of an interrupted download with a range
+// request. The mirror the download was started from is tried first if the
+// download can be validated with an ETag or a modification time. Other
+// mirrors are only used if the result can be verified against the
+// repository database.
+func (c *Cache) resumeDownload(dl *ongoingDownload) (io.ReadCloser, error) {
+	offset := atomic.LoadInt64(&dl.written)
+	if dl.filesize < 0 {
+		return nil, errors.New("Download with unknown size can't be resumed")
+	}
+
+	mirrors := append(mirrorlist.Mirrorlist{dl.mirror}, c.rankedMirrors(&dl.Dl.R)...)
+	for i, mirror := range mirrors {
+		if i > 0 && mirror == dl.mirror {
+			continue
+		}
+
+		same := mirror == dl.mirror
+		if !verifiable(dl.info) && (!same || dl.validator == "") {
+			continue
+		}
+
+		req, _ := http.NewRequest("GET", mirror.PacketURL(&dl.Dl.P, &dl.Dl.R), nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if same && dl.validator != "" {
+			req.Header.Set("If-Range", dl.validator)
+		}
+
+		resp, err := c.do(dl.ctx, req, mirror)
+		if err != nil {
+			continue
+		}
+
+		if resp.StatusCode != 206 {
+			resp.Body.Close()
+			continue
+		}
+
+		start, filesize, ok := contentRange(resp)
+		if !ok || start != offset || filesize != dl.filesize {
+			resp.Body.Close()
+			continue
+		}
+
+		log.Println("Resuming download of", dl.Dl.Path(), "at byte", offset, "from", mirror)
+		dl.mirror = mirror
+		return resp.Body, nil
 	}
 
-	return nil, errors.New("Packet could not be downloaded from any mirror")
+	return nil, errors.New("Download could not be resumed from any mirror")
 }
 
 // Asynchronous callback for a finished download
 // The function will rename the .part file to the original file and register it
 // in the cache registry.
 func (c *Cache) finalizeDownload(dl *ongoingDownload, err error) {
+	defer c.wg.Done()
+
+	// Old versions are kept while the live database still references them
+	// because a new one is staged, they are removed once it is live. The
+	// archive removes them once no previous database references them.
+	c.repoMu.Lock()
+	keepOld := c.isStaging(&dl.Dl.R) || c.Archive().Enabled
+	c.repoMu.Unlock()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	defer dl.cancel()
 
 	// Rename donwloaded file to final filename in cache
 	err = os.Rename(dl.filename, filepath.Join(c.directory, dl.Dl.Path()))
 	if err != nil {
 		err = errors.Wrap(err, "Failed moving file")
 		log.Println(err)
+		dl.finish(downloadFailed, err)
 		os.Remove(dl.filename)
 		delete(c.downloads, dl.Dl.Path())
 		dl.Dl.Callback(err)
 		return
 	}
 
+	size := atomic.LoadInt64(&dl.written)
+	if dl.signature != nil {
+		err = c.storeSignature(&dl.Dl, dl.signature)
+		if err != nil {
+			log.Println(err)
+		} else {
+			size += int64(len(dl.signature))
+		}
+	}
+
 	// Remove old versions
 	for _, p := range c.packets[dl.Dl.R].FindOtherVersions(&dl.Dl.P) {
 		diff := packet.CompareVersions(p.Version, dl.Dl.P.Version)
-		if diff < 0 {
-			os.Remove(filepath.Join(c.directory, dl.Dl.R.Arch, dl.Dl.R.Name, p.Filename()))
-			c.packets[dl.Dl.R].Delete(p.Filename())
+		if diff < 0 && !keepOld {
+			c.removePacket(p, dl.Dl.R)
 			log.Println("Removed old packet", filepath.Join(dl.Dl.R.Arch, dl.Dl.R.Name, p.Filename()))
 		}
 	}
@@ -171,8 +499,11 @@ func (c *Cache) finalizeDownload(dl *ongoingDownload, err error) {
 	}
 
 	c.packets[dl.Dl.R].Insert(&dl.Dl.P)
+	c.track(&dl.Dl.P, dl.Dl.R, size, time.Now())
 	delete(c.downloads, dl.Dl.Path())
+	c.evict(dl.Dl.Path())
 
+	dl.finish(downloadComplete, nil)
 	log.Println("Packet", dl.Dl.R, dl.Dl.P.Filename(), "now available!")
 	dl.Dl.Callback(nil)
 }
@@ -180,8 +511,11 @@ func (c *Cache) finalizeDownload(dl *ongoingDownload, err error) {
 // backgroundDownload will start the given download in the background.
 // Only one background download will be active at a given time
 func (c *Cache) backgroundDownload(dl *download) error {
+	atomic.AddInt64(&c.bgQueued, 1)
 	c.bgDownload.Lock()
+	atomic.AddInt64(&c.bgQueued, -1)
 	defer c.bgDownload.Unlock()
+	info, _ := c.lookupInfo(dl)
 	c.mu.Lock()
 	if _, ok := c.downloads[dl.Path()]; ok {
 		c.mu.Unlock()
@@ -196,7 +530,7 @@ func (c *Cache) backgroundDownload(dl *download) error {
 	log.Println("Downloading", dl.Path())
 	result := make(chan error)
 	dl.Chan = result
-	_, err := c.startDownload(dl)
+	_, err := c.startDownload(dl, info)
 	c.mu.Unlock()
 
 	if err != nil {
@@ -215,49 +549,88 @@ func (c *Cache) backgroundDownload(dl *download) error {
 	return nil
 }
 
-// countWriter wraps a writer. The total number of bytes written will be appended to *Written
-// in an atomic manner.
+// countWriter wraps a writer. The total number of bytes written will be added to
+// the written bytes of Dl in an atomic manner and readers of Dl are notified.
 type countWriter struct {
-	W       io.Writer
-	Written *int64
+	W  io.Writer
+	Dl *ongoingDownload
 }
 
 func (l *countWriter) Write(p []byte) (int, error) {
 	n, err := l.W.Write(p)
-	atomic.AddInt64(l.Written, int64(n))
+	if n > 0 {
+		atomic.AddInt64(&l.Dl.written, int64(n))
+		l.Dl.notify()
+	}
 	return n, err
 }
 
 // dynamicLimitReaderWithSize allows files to be read that aren't written completly
 // Expects that
-//  - Limit grows steadily
-//  - R returns EOF after Size
+//   - the written bytes of Dl grow steadily
+//   - R returns EOF after Size
+//
 // Guarantuees that
-//  - R is not read after limit
+//   - R is not read beyond the written bytes
+//   - reads block until data is available instead of returning nothing
+//   - the last byte is not read until the state of Dl is downloadVerified
+//   - reading fails with the error of Dl once it failed or got cancelled
 //
 // Additionally passes through close commands if R also is a closer
 type dynamicLimitReaderWithSize struct {
-	R     io.ReadSeeker
-	Size  int64
-	Limit *int64
-	pos   int64
+	R    io.ReadSeeker
+	Size int64
+	Dl   *ongoingDownload
+	// waiting for data fails once Ctx is done
+	Ctx context.Context
+	pos int64
 }
 
 func (d *dynamicLimitReaderWithSize) Read(p []byte) (n int, err error) {
-	limit := atomic.LoadInt64(d.Limit)
-	if d.pos >= limit {
-		// still waiting for data to get available
+	if len(p) == 0 {
 		return 0, nil
 	}
 
-	if d.pos+int64(len(p)) > limit {
-		// reading would go beyond limit
-		p = p[:int(limit-d.pos)]
-	}
+	for {
+		// Get the notification channel before checking the state so no
+		// change in between is missed
+		changed := d.Dl.changes()
+
+		limit := atomic.LoadInt64(&d.Dl.written)
+		state := atomic.LoadInt32(&d.Dl.state)
+		switch state {
+		case downloadFailed, downloadCancelled:
+			return 0, d.Dl.failure()
+		case downloadRunning:
+			// Hold back the last byte so clients never receive a complete
+			// file that turns out to be corrupt
+			if limit >= d.Size {
+				limit = d.Size - 1
+			}
+		}
+
+		if d.pos < limit {
+			if d.pos+int64(len(p)) > limit {
+				// reading would go beyond limit
+				p = p[:int(limit-d.pos)]
+			}
+
+			n, err = d.R.Read(p)
+			d.pos += int64(n)
+			return
+		}
 
-	n, err = d.R.Read(p)
-	d.pos += int64(n)
-	return
+		if state != downloadRunning {
+			return 0, io.EOF
+		}
+
+		// still waiting for data to get available
+		select {
+		case <-changed:
+		case <-d.Ctx.Done():
+			return 0, d.Ctx.Err()
+		}
+	}
 }
 
 func (d *dynamicLimitReaderWithSize) Seek(offset int64, whence int) (int64, error) {
@@ -272,15 +645,13 @@ func (d *dynamicLimitReaderWithSize) Seek(offset int64, whence int) (int64, erro
 		return d.pos, errors.New("Invalid whence")
 	}
 
-	// Also tell the underlying reader to seek so that we read properly
-	//TODO: error handling
-	d.R.Seek(offset, whence)
-
 	if d.pos > d.Size || d.pos < 0 {
 		return d.pos, errors.New("Seek out of bounds")
 	}
 
-	return d.pos, nil
+	// Also tell the underlying reader to seek so that we read properly
+	_, err := d.R.Seek(d.pos, io.SeekStart)
+	return d.pos, err
 }
 
 func (d *dynamicLimitReaderWithSize) Close() error {
@@ -0,0 +1,391 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/test"
+)
+
+// countingReadSeeker counts the calls to Read
+type countingReadSeeker struct {
+	io.ReadSeeker
+	reads int32
+}
+
+func (c *countingReadSeeker) Read(p []byte) (int, error) {
+	atomic.AddInt32(&c.reads, 1)
+	return c.ReadSeeker.Read(p)
+}
+
+// newTestDownload creates an ongoing download writing to a file in dir and a
+// reader for it
+func newTestDownload(t *testing.T, dir string, size int64) (*ongoingDownload, *os.File, *countingReadSeeker, ReadSeekCloser) {
+	dl := &ongoingDownload{
+		filesize: size,
+		filename: filepath.Join(dir, "test.part"),
+		changed:  make(chan struct{}),
+	}
+	f, err := os.Create(dl.filename)
+	assert.NoError(t, err)
+
+	r, err := os.Open(dl.filename)
+	assert.NoError(t, err)
+	counting := &countingReadSeeker{ReadSeeker: r}
+	return dl, f, counting, &dynamicLimitReaderWithSize{R: counting, Size: size, Dl: dl, Ctx: context.Background()}
+}
+
+func TestReaderWaits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dl, f, counting, r := newTestDownload(t, dir, 10)
+	defer f.Close()
+	defer r.Close()
+
+	result := make(chan []byte)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		result <- b
+	}()
+
+	w := &countWriter{f, dl}
+	_, err = w.Write([]byte("hello"))
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = w.Write([]byte("world"))
+	assert.NoError(t, err)
+
+	// The last byte is held back until the download is verified
+	select {
+	case <-result:
+		assert.Fail(t, "Read finished before the download was verified")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	dl.finish(downloadVerified, nil)
+	assert.Equal(t, "helloworld", string(<-result))
+
+	// Readers block instead of polling the file
+	assert.True(t, atomic.LoadInt32(&counting.reads) <= 4, "%d reads", counting.reads)
+}
+
+func TestReaderFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dl, f, _, r := newTestDownload(t, dir, 10)
+	defer f.Close()
+	defer r.Close()
+
+	result := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(r)
+		result <- err
+	}()
+
+	_, err = (&countWriter{f, dl}).Write([]byte("hello"))
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	failure := errors.New("connection reset")
+	dl.finish(downloadFailed, failure)
+	select {
+	case err := <-result:
+		assert.Equal(t, failure, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Reader not woken up by failure")
+	}
+}
+
+// newTestCache creates a cache in a temporary directory using the given server as mirror
+func newTestCache(t *testing.T, s *test.Server) (*Cache, string) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+
+	c, err := New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(s.URL)})
+	assert.NoError(t, err)
+	return c, dir
+}
+
+// readWithTimeout reads r completely and fails the test if that takes too long
+func readWithTimeout(t *testing.T, r io.Reader) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		done <- result{b, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Reader didn't finish in time")
+		return nil, nil
+	}
+}
+
+func TestDownloadFailed(t *testing.T) {
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+
+		// Drop the connection after half of the file, without a validator
+		// the download can't be resumed
+		w.Header().Set("Content-Length", strconv.Itoa(len(_bigContent)))
+		io.WriteString(w, _bigContent[:len(_bigContent)/2])
+	})
+	defer s.StopServer(t)
+
+	c, dir := newTestCache(t, s)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	b, err := readWithTimeout(t, r)
+	assert.Error(t, err)
+	assert.True(t, len(b) < len(_bigContent))
+	assert.NoError(t, r.Close())
+
+	c.mu.Lock()
+	assert.Equal(t, 0, len(c.downloads))
+	assert.Nil(t, c.packets[repo].ByFilename(_filename))
+	c.mu.Unlock()
+	_, err = os.Stat(filepath.Join(dir, _arch, _repo, _filename+".part"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	release := make(chan struct{})
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(_bigContent)))
+		io.WriteString(w, _bigContent[:len(_bigContent)/2])
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	defer s.StopServer(t)
+	defer close(release)
+
+	c, dir := newTestCache(t, s)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.NoError(t, c.CancelDownload(p, &repo))
+	b, err := readWithTimeout(t, r)
+	assert.Equal(t, ErrCancelled, err)
+	assert.True(t, len(b) < len(_bigContent))
+
+	for i := 0; i < 100 && len(c.Downloads()) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, len(c.Downloads()))
+	assert.Equal(t, ErrNotDownloading, c.CancelDownload(p, &repo))
+}
+
+func TestDownloadComplete(t *testing.T) {
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+		http.ServeContent(w, &http.Request{}, filename, time.Time{}, strings.NewReader(_bigContent))
+	})
+	defer s.StopServer(t)
+
+	c, dir := newTestCache(t, s)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	d := &download{P: *p, R: repo}
+	info, _ := c.lookupInfo(d)
+	c.mu.Lock()
+	dl, err := c.startDownload(d, info)
+	c.mu.Unlock()
+	assert.NoError(t, err)
+	r, err := dl.GetReader(context.Background())
+	assert.NoError(t, err)
+	defer r.Close()
+
+	b, err := readWithTimeout(t, r)
+	assert.NoError(t, err)
+	assert.Equal(t, _bigContent, string(b))
+
+	waitCached(t, c, repo, _filename)
+	assert.Equal(t, downloadComplete, atomic.LoadInt32(&dl.state))
+}
+
+func TestReaderContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dl, f, _, r := newTestDownload(t, dir, 10)
+	defer f.Close()
+	defer r.Close()
+
+	// A disconnected client stops waiting for the download
+	ctx, cancel := context.WithCancel(context.Background())
+	r.(*dynamicLimitReaderWithSize).Ctx = ctx
+	_, err = (&countWriter{f, dl}).Write([]byte("hello"))
+	assert.NoError(t, err)
+	cancel()
+
+	b, err := readWithTimeout(t, r)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "hello", string(b))
+	assert.Equal(t, downloadRunning, atomic.LoadInt32(&dl.state))
+}
+
+func TestDownloadStalled(t *testing.T) {
+	release := make(chan struct{})
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(_bigContent)))
+		io.WriteString(w, _bigContent[:len(_bigContent)/2])
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	defer s.StopServer(t)
+	defer close(release)
+
+	c, dir := newTestCache(t, s)
+	defer os.RemoveAll(dir)
+	u := DefaultUpstream()
+	u.StallTimeout = 50 * time.Millisecond
+	c.SetUpstream(u)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// Without a validator the stalled download can't be resumed
+	b, err := readWithTimeout(t, r)
+	assert.Error(t, err)
+	assert.Equal(t, len(_bigContent)/2, len(b))
+	assert.Equal(t, int64(1), c.Mirrors()[0].Failures)
+}
+
+func TestClosePersistsUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const existing = "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz"
+	filename := filepath.Join(dir, _arch, _repo, existing)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("packet"), 0644))
+	old := time.Now().Add(-48 * time.Hour)
+	assert.NoError(t, os.Chtimes(filename, old, old))
+
+	c, err := New(dir, mirrorlist.Mirrorlist{})
+	assert.NoError(t, err)
+	p, err := packet.FromFilename(existing)
+	assert.NoError(t, err)
+	r, err := c.GetPacket(context.Background(), p, &database.Repository{Name: _repo, Arch: _arch})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+
+	assert.NoError(t, c.Close(context.Background()))
+	stat, err := os.Stat(filename)
+	assert.NoError(t, err)
+	assert.True(t, stat.ModTime().After(old.Add(time.Hour)))
+}
+
+func TestClose(t *testing.T) {
+	release := make(chan struct{})
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(_bigContent)))
+		io.WriteString(w, _bigContent[:len(_bigContent)/2])
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	defer s.StopServer(t)
+	defer close(release)
+
+	c, dir := newTestCache(t, s)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, c.Close(ctx))
+	assert.Equal(t, 0, len(c.Downloads()))
+
+	_, err = readWithTimeout(t, r)
+	assert.Error(t, err)
+
+	// The interrupted download is kept to be resumed later
+	stat, err := os.Stat(filepath.Join(dir, _arch, _repo, _filename+".part"))
+	assert.NoError(t, err)
+	if err == nil {
+		assert.Equal(t, int64(len(_bigContent)/2), stat.Size())
+	}
+
+	// No new downloads are started after closing
+	other, err := packet.FromFilename("zbar-0.23-1-x86_64.pkg.tar.xz")
+	assert.NoError(t, err)
+	_, err = c.GetPacket(context.Background(), other, &repo)
+	assert.Error(t, err)
+}
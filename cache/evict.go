@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// Limits describes the bounds the cache has to stay within.
+// A zero value disables the respective limit.
+type Limits struct {
+	// MaxSize is the maximum number of bytes all cached packets may use
+	MaxSize int64
+	// MinFree is the number of bytes that should always stay free on the
+	// filesystem the cache directory is located on
+	MinFree int64
+}
+
+// usage stores the information needed to decide which packets to evict
+type usage struct {
+	repo       database.Repository
+	p          *packet.Packet
+	size       int64
+	lastAccess time.Time
+}
+
+// SetLimits sets new size limits for the cache and evicts packets if the
+// cache is currently exceeding them
+func (c *Cache) SetLimits(l Limits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limits = l
+	c.evict("")
+}
+
+// Size returns the total number of bytes used by the cached packets
+func (c *Cache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// Evictions returns the number of packets evicted since the cache was created
+func (c *Cache) Evictions() int64 {
+	return atomic.LoadInt64(&c.evictions)
+}
+
+// repoSizes returns the size of the cached packets of each repository.
+// c.mu has to be held by the caller.
+func (c *Cache) repoSizes() map[database.Repository]int64 {
+	sizes := make(map[database.Repository]int64)
+	for _, u := range c.usage {
+		sizes[u.repo] += u.size
+	}
+
+	return sizes
+}
+
+// track registers a cached packet file for eviction.
+// c.mu has to be held by the caller.
+func (c *Cache) track(p *packet.Packet, repo database.Repository, size int64, lastAccess time.Time) {
+	path := filepath.Join(repo.Arch, repo.Name, p.Filename())
+	if old, ok := c.usage[path]; ok {
+		c.size -= old.size
+	}
+
+	c.usage[path] = &usage{
+		repo:       repo,
+		p:          p,
+		size:       size,
+		lastAccess: lastAccess,
+	}
+	c.size += size
+}
+
+// untrack removes a packet file from the eviction registry.
+// c.mu has to be held by the caller.
+func (c *Cache) untrack(p *packet.Packet, repo database.Repository) {
+	path := filepath.Join(repo.Arch, repo.Name, p.Filename())
+	if old, ok := c.usage[path]; ok {
+		c.size -= old.size
+		delete(c.usage, path)
+	}
+}
+
+// grow adds n bytes to the size of a tracked packet.
+// c.mu has to be held by the caller.
+func (c *Cache) grow(p *packet.Packet, repo database.Repository, n int64) {
+	if u, ok := c.usage[filepath.Join(repo.Arch, repo.Name, p.Filename())]; ok {
+		u.size += n
+		c.size += n
+	}
+}
+
+// touch marks the given packet as accessed right now.
+// c.mu has to be held by the caller.
+func (c *Cache) touch(p *packet.Packet, repo database.Repository) {
+	if u, ok := c.usage[filepath.Join(repo.Arch, repo.Name, p.Filename())]; ok {
+		u.lastAccess = time.Now()
+	}
+}
+
+// persistUsage stores the access times of all cached packets as their
+// modification times so they are restored on the next start
+func (c *Cache) persistUsage() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for path, u := range c.usage {
+		chErr := os.Chtimes(filepath.Join(c.directory, path), u.lastAccess, u.lastAccess)
+		if chErr != nil && !os.IsNotExist(chErr) {
+			err = errors.Wrap(chErr, "Error persisting access time")
+			log.Println(err)
+		}
+	}
+
+	return err
+}
+
+// removePacket deletes a cached packet together with its signature from the
+// disk and the cache registry.
+// c.mu has to be held by the caller.
+func (c *Cache) removePacket(p *packet.Packet, repo database.Repository) error {
+	path := filepath.Join(c.directory, repo.Arch, repo.Name, p.Filename())
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	os.Remove(path + ".sig")
+	c.packets[repo].Delete(p.Filename())
+	c.untrack(p, repo)
+	return nil
+}
+
+// evict removes the least recently used packets until the cache is within
+// its limits again. The packet with the path keep will never be removed.
+// Packets that are currently being downloaded are not considered as they
+// are not part of the cache registry until they are finalized.
+// c.mu has to be held by the caller.
+func (c *Cache) evict(keep string) {
+	var toFree int64
+	if c.limits.MaxSize > 0 && c.size > c.limits.MaxSize {
+		toFree = c.size - c.limits.MaxSize
+	}
+
+	if c.limits.MinFree > 0 {
+		free, err := freeSpace(c.directory)
+		if err != nil {
+			log.Println("Error checking free disk space:", err)
+		} else if free < c.limits.MinFree && c.limits.MinFree-free > toFree {
+			toFree = c.limits.MinFree - free
+		}
+	}
+
+	if toFree <= 0 {
+		return
+	}
+
+	candidates := make([]string, 0, len(c.usage))
+	for path := range c.usage {
+		if path == keep {
+			continue
+		}
+		if _, ok := c.downloads[path]; ok {
+			continue
+		}
+		candidates = append(candidates, path)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.usage[candidates[i]].lastAccess.Before(c.usage[candidates[j]].lastAccess)
+	})
+
+	for _, path := range candidates {
+		if toFree <= 0 {
+			break
+		}
+
+		u := c.usage[path]
+		err := c.removePacket(u.p, u.repo)
+		if err != nil {
+			log.Println("Error evicting", path, err)
+			continue
+		}
+
+		toFree -= u.size
+		atomic.AddInt64(&c.evictions, 1)
+		log.Printf("Evicted %s (%d bytes, last access %s)", path, u.size, u.lastAccess.Format(time.RFC3339))
+	}
+
+	if toFree > 0 {
+		log.Println("Cache still exceeds its limits after evicting all possible packets")
+	}
+}
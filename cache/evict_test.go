@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+func TestEvict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	files := []string{
+		"a-1.0-1-x86_64.pkg.tar.xz",
+		"b-1.0-1-x86_64.pkg.tar.xz",
+		"c-1.0-1-x86_64.pkg.tar.xz",
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, _arch, _repo), 0755))
+	for _, f := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, _arch, _repo, f), make([]byte, 100), 0644))
+	}
+
+	c, err := New(dir, mirrorlist.Mirrorlist{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(300), c.Size())
+
+	repo := database.Repository{
+		Name: _repo,
+		Arch: _arch,
+	}
+
+	// Access order: b, c, a
+	now := time.Now()
+	for i, f := range []string{files[1], files[2], files[0]} {
+		c.usage[filepath.Join(_arch, _repo, f)].lastAccess = now.Add(time.Duration(i-3) * time.Minute)
+	}
+
+	// Nothing to be done
+	c.SetLimits(Limits{MaxSize: 300})
+	assert.Equal(t, int64(0), c.Evictions())
+	assert.Equal(t, 3, len(c.packets[repo]))
+
+	c.SetLimits(Limits{MaxSize: 150})
+	assert.Equal(t, int64(2), c.Evictions())
+	assert.Equal(t, int64(100), c.Size())
+	assert.Equal(t, 1, len(c.packets[repo]))
+	assert.NotNil(t, c.packets[repo].ByFilename(files[0]))
+	for _, f := range files[1:] {
+		_, err = os.Stat(filepath.Join(dir, _arch, _repo, f))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Accessing the packet updates the access time
+	p, err := packet.FromFilename(files[0])
+	assert.NoError(t, err)
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.True(t, c.usage[filepath.Join(_arch, _repo, files[0])].lastAccess.After(now))
+}
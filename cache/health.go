@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+// SetMirrors replaces the mirrors used for new requests. Ongoing downloads
+// keep using their mirrors.
+func (c *Cache) SetMirrors(mirrors mirrorlist.Mirrorlist) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.mirrors = mirrors
+}
+
+// getMirrors returns the mirrors in the order of the mirrorlist
+func (c *Cache) getMirrors() mirrorlist.Mirrorlist {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	return c.mirrors
+}
+
+// rankedMirrors returns the mirrors carrying the given repository ordered by
+// their health, best first
+func (c *Cache) rankedMirrors(repo *database.Repository) mirrorlist.Mirrorlist {
+	return c.health.Rank(c.mirrorsFor(repo))
+}
+
+// Mirrors returns the recorded health of the mirrors of all routes in the
+// order they are currently tried in
+func (c *Cache) Mirrors() []mirrorlist.MirrorStats {
+	return c.health.Stats(c.health.Rank(c.allMirrors()))
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/test"
+)
+
+func TestMirrorHealth(t *testing.T) {
+	var brokenCalls int32
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".pkg.tar.xz") {
+			atomic.AddInt32(&brokenCalls, 1)
+		}
+		w.WriteHeader(503)
+	}))
+	defer broken.Close()
+
+	good := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+		http.ServeContent(w, &http.Request{}, filename, time.Time{}, strings.NewReader(_content))
+	})
+	defer good.StopServer(t)
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mirrors := mirrorlist.Mirrorlist{mirrorlist.Mirror(broken.URL + "/$repo/os/$arch"), mirrorlist.Mirror(good.URL)}
+	c, err := New(dir, mirrors)
+	assert.NoError(t, err)
+	repo := database.Repository{Name: _repo, Arch: _arch}
+
+	for _, filename := range []string{"a-1-1-any.pkg.tar.xz", "b-1-1-any.pkg.tar.xz", "c-1-1-any.pkg.tar.xz", "d-1-1-any.pkg.tar.xz"} {
+		p, err := packet.FromFilename(filename)
+		assert.NoError(t, err)
+		r, err := c.GetPacket(context.Background(), p, &repo)
+		assert.NoError(t, err)
+		if err == nil {
+			r.Close()
+		}
+		waitCached(t, c, repo, filename)
+	}
+
+	// The broken mirror is skipped after reaching the failure threshold
+	assert.True(t, atomic.LoadInt32(&brokenCalls) <= mirrorlist.FailureThreshold)
+
+	stats := c.Mirrors()
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, mirrors[1], stats[0].Mirror)
+	assert.True(t, stats[0].Successes > 0)
+	assert.Equal(t, mirrors[0], stats[1].Mirror)
+	assert.True(t, stats[1].Failures >= mirrorlist.FailureThreshold)
+	assert.Equal(t, "503 Service Unavailable", stats[1].LastError)
+	assert.True(t, stats[1].CooldownUntil.After(time.Now()))
+
+	text := metricsText(t, c)
+	assert.Contains(t, text, `smartmirror_mirror_cooldown{mirror="`+string(mirrors[0])+`"} 1`)
+	assert.Contains(t, text, `smartmirror_mirror_cooldown{mirror="`+string(mirrors[1])+`"} 0`)
+}
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// ErrNotCached is returned when a packet that should be modified is not in the cache
+var ErrNotCached = errors.New("Packet not in cache")
+
+// ErrNotDownloading is returned when a download that should be cancelled is
+// not running
+var ErrNotDownloading = errors.New("Packet not being downloaded")
+
+// PacketInfo describes a cached packet
+type PacketInfo struct {
+	Filename   string    `json:"filename"`
+	Name       string    `json:"name"`
+	Version    string    `json:"version"`
+	Arch       string    `json:"arch"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+}
+
+// RepoInfo describes a repository known to the cache
+type RepoInfo struct {
+	Name string `json:"name"`
+	Arch string `json:"arch"`
+	// Updated is the modification time of the cached database, zero if
+	// the database isn't cached
+	Updated time.Time `json:"updated"`
+	// Staged is the modification time of a new database waiting for its
+	// packets to be downloaded, nil if none is staged
+	Staged  *time.Time   `json:"staged,omitempty"`
+	Size    int64        `json:"size"`
+	Packets []PacketInfo `json:"packets"`
+}
+
+// DownloadInfo describes the progress of an ongoing download
+type DownloadInfo struct {
+	Repo     string `json:"repo"`
+	Arch     string `json:"arch"`
+	Filename string `json:"filename"`
+	Written  int64  `json:"written"`
+	// Size is the total size of the file, -1 if unknown
+	Size int64 `json:"size"`
+}
+
+// Repos returns information about all repositories with a cached database
+// or cached packets sorted by architecture and name.
+func (c *Cache) Repos() []RepoInfo {
+	repos := make(map[database.Repository]*RepoInfo)
+	get := func(repo database.Repository) *RepoInfo {
+		info, ok := repos[repo]
+		if !ok {
+			info = &RepoInfo{
+				Name:    repo.Name,
+				Arch:    repo.Arch,
+				Packets: make([]PacketInfo, 0),
+			}
+			repos[repo] = info
+		}
+		return info
+	}
+
+	c.repoMu.Lock()
+	for repo := range c.repos {
+		info := get(repo)
+		if stat, err := os.Stat(c.repoPath(&repo, database.DB)); err == nil {
+			info.Updated = stat.ModTime()
+		}
+		if c.isStaging(&repo) {
+			if stat, err := os.Stat(c.repoPath(&repo, database.DB) + stagedSuffix); err == nil {
+				staged := stat.ModTime()
+				info.Staged = &staged
+			}
+		}
+	}
+	c.repoMu.Unlock()
+
+	c.mu.Lock()
+	for repo, packets := range c.packets {
+		info := get(repo)
+		for _, p := range packets {
+			pi := PacketInfo{
+				Filename: p.Filename(),
+				Name:     p.Name,
+				Version:  p.Version,
+				Arch:     p.Arch,
+			}
+			if u, ok := c.usage[filepath.Join(repo.Arch, repo.Name, p.Filename())]; ok {
+				pi.Size = u.size
+				pi.LastAccess = u.lastAccess
+			}
+			info.Size += pi.Size
+			info.Packets = append(info.Packets, pi)
+		}
+	}
+	c.mu.Unlock()
+
+	result := make([]RepoInfo, 0, len(repos))
+	for _, info := range repos {
+		sort.Slice(info.Packets, func(i, j int) bool {
+			return info.Packets[i].Filename < info.Packets[j].Filename
+		})
+		result = append(result, *info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Arch != result[j].Arch {
+			return result[i].Arch < result[j].Arch
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result
+}
+
+// Downloads returns the progress of all ongoing downloads sorted by path
+func (c *Cache) Downloads() []DownloadInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := make([]DownloadInfo, 0, len(c.downloads))
+	for _, dl := range c.downloads {
+		result = append(result, DownloadInfo{
+			Repo:     dl.Dl.R.Name,
+			Arch:     dl.Dl.R.Arch,
+			Filename: dl.Dl.P.Filename(),
+			Written:  atomic.LoadInt64(&dl.written),
+			Size:     dl.filesize,
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return filepath.Join(result[i].Arch, result[i].Repo, result[i].Filename) <
+			filepath.Join(result[j].Arch, result[j].Repo, result[j].Filename)
+	})
+
+	return result
+}
+
+// DeletePacket removes a packet together with its signature from the cache.
+// Returns ErrNotCached if the packet isn't cached.
+func (c *Cache) DeletePacket(p *packet.Packet, repo *database.Repository) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.packets[*repo].ByFilename(p.Filename()) == nil {
+		return ErrNotCached
+	}
+
+	err := c.removePacket(p, *repo)
+	if err != nil {
+		return errors.Wrap(err, "Error removing packet")
+	}
+
+	log.Println("Deleted packet", filepath.Join(repo.Arch, repo.Name, p.Filename()))
+	return nil
+}
+
+// CancelDownload cancels the ongoing download of a packet. Clients served from
+// the download receive an error. Returns ErrNotDownloading if the packet isn't
+// being downloaded or its download already finished.
+func (c *Cache) CancelDownload(p *packet.Packet, repo *database.Repository) error {
+	d := download{P: *p, R: *repo}
+
+	c.mu.Lock()
+	dl, ok := c.downloads[d.Path()]
+	c.mu.Unlock()
+	if !ok || atomic.LoadInt32(&dl.state) != downloadRunning {
+		return ErrNotDownloading
+	}
+
+	dl.cancel()
+	return nil
+}
+
+// RefreshRepo downloads the latest version of the given repository's
+// database and updates the cached packets and the other cached artifacts of
+// the repository afterwards.
+// If no immediate error is returned, the result of the database update will be
+// sent to the channel if it isn't nil.
+func (c *Cache) RefreshRepo(repo *database.Repository, result chan<- error) error {
+	subresult := make(chan error)
+	err := c.downloadRepo(c.ctx, repo, database.DB, subresult)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := <-subresult
+		go c.updatePackets(*repo)
+		if artifactErr := c.refreshArtifacts(*repo); err == nil {
+			err = artifactErr
+		}
+
+		if result != nil {
+			result <- err
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/pgp"
+)
+
+// quarantineDir is the directory in the cache holding downloads that failed
+// the signature verification. Architectures never start with a dot, so it
+// can't collide with a repository.
+const quarantineDir = ".quarantine"
+
+// SetKeyring sets the keyring downloaded packets and databases are verified
+// with before they are cached, nil disables the verification
+func (c *Cache) SetKeyring(k *pgp.Keyring) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.keyring = k
+}
+
+// getKeyring returns the keyring to verify downloads with, nil if disabled
+func (c *Cache) getKeyring() *pgp.Keyring {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	return c.keyring
+}
+
+// verifyFile checks the detached signature of the given file
+func verifyFile(k *pgp.Keyring, filename string, sig []byte) error {
+	if sig == nil {
+		return errors.New("No signature available")
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrap(err, "Error opening file to verify")
+	}
+	defer f.Close()
+
+	return k.Verify(f, sig)
+}
+
+// verifyPacket checks the signature of a downloaded packet. The signature
+// from the repository database is used if the mirrors had none.
+func verifyPacket(k *pgp.Keyring, dl *ongoingDownload) error {
+	sig := dl.signature
+	if sig == nil && dl.info != nil && dl.info.PGPSig != "" {
+		var err error
+		sig, err = base64.StdEncoding.DecodeString(dl.info.PGPSig)
+		if err != nil {
+			return errors.Wrap(err, "Invalid signature in database")
+		}
+	}
+
+	return errors.Wrapf(verifyFile(k, dl.filename, sig), "Error verifying %s", dl.Dl.Path())
+}
+
+// quarantine moves a download that failed the signature verification into
+// the quarantine directory together with its signature. rel is the path of
+// the file relative to the cache directory.
+func (c *Cache) quarantine(filename, rel string, sig []byte, kind string) {
+	c.metrics.quarantined.WithLabelValues(kind).Inc()
+
+	target := filepath.Join(c.directory, quarantineDir, rel)
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err == nil {
+		err = os.Rename(filename, target)
+	}
+	if err == nil && sig != nil {
+		err = ioutil.WriteFile(target+".sig", sig, 0644)
+	}
+	if err != nil {
+		log.Println(errors.Wrapf(err, "Error quarantining %s", rel))
+		os.Remove(filename)
+		return
+	}
+
+	log.Println("Quarantined", rel, "to", target)
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/pgp"
+	"github.com/veecue/pacman-smartmirror/test"
+)
+
+// newTestKeyring creates a keyring with a new key and a function signing
+// data with it
+func newTestKeyring(t *testing.T) (*pgp.Keyring, func(string) []byte) {
+	e, err := openpgp.NewEntity("Packager", "", "packager@example.com", nil)
+	assert.NoError(t, err)
+
+	var pub bytes.Buffer
+	assert.NoError(t, e.Serialize(&pub))
+	k, err := pgp.ReadKeyring(&pub)
+	assert.NoError(t, err)
+
+	return k, func(data string) []byte {
+		var sig bytes.Buffer
+		assert.NoError(t, openpgp.DetachSign(&sig, e, strings.NewReader(data), nil))
+		return sig.Bytes()
+	}
+}
+
+// waitFile waits until the given file exists
+func waitFile(t *testing.T, filename string) {
+	for i := 0; i < 1000; i++ {
+		if _, err := os.Stat(filename); err == nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Fail(t, "File not created in time", filename)
+}
+
+func TestKeyringPacket(t *testing.T) {
+	keyring, sign := newTestKeyring(t)
+	var sig atomic.Value
+	sig.Store(sign(_content))
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.Write(sig.Load().([]byte))
+			return
+		}
+		http.ServeContent(w, &http.Request{}, filename, time.Time{}, strings.NewReader(_content))
+	})
+	defer s.StopServer(t)
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	const other = "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz"
+	repo := database.Repository{
+		Name: _repo,
+		Arch: _arch,
+	}
+	writeTestDB(t, dir, repo, _content, _filename, other)
+
+	c, err := New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(s.URL)})
+	assert.NoError(t, err)
+	c.SetKeyring(keyring)
+
+	download := func(filename string) ReadSeekCloser {
+		p, err := packet.FromFilename(filename)
+		assert.NoError(t, err)
+		d := &download{P: *p, R: repo}
+		info, _ := c.lookupInfo(d)
+		c.mu.Lock()
+		dl, err := c.startDownload(d, info)
+		c.mu.Unlock()
+		assert.NoError(t, err)
+		r, err := dl.GetReader(context.Background())
+		assert.NoError(t, err)
+		return r
+	}
+
+	// Packets with a valid signature are cached
+	r := download(_filename)
+	b, err := readWithTimeout(t, r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, _content, string(b))
+	waitCached(t, c, repo, _filename)
+
+	// Packets signed by an unknown key are quarantined, clients don't
+	// receive all of their data
+	_, signOther := newTestKeyring(t)
+	sig.Store(signOther(_content))
+	r = download(other)
+	_, err = readWithTimeout(t, r)
+	assert.Error(t, err)
+	assert.NoError(t, r.Close())
+
+	quarantined := filepath.Join(dir, quarantineDir, _arch, _repo, other)
+	waitFile(t, quarantined+".sig")
+	b, err = ioutil.ReadFile(quarantined)
+	assert.NoError(t, err)
+	assert.Equal(t, _content, string(b))
+	_, err = os.Stat(filepath.Join(dir, _arch, _repo, other))
+	assert.True(t, os.IsNotExist(err))
+	c.mu.Lock()
+	assert.Nil(t, c.packets[repo].ByFilename(other))
+	c.mu.Unlock()
+
+	// The quarantine is ignored when loading the cache
+	c, err = New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(s.URL)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(_content))+int64(len(sign(_content))), c.Size())
+}
+
+func TestKeyringDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyring, sign := newTestKeyring(t)
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	var db, sig []byte
+	modTime := time.Now().Add(-time.Hour)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + _repo + ".db":
+			http.ServeContent(w, r, r.URL.Path, modTime, bytes.NewReader(db))
+		case "/" + _repo + ".db.sig":
+			if sig == nil {
+				w.WriteHeader(404)
+				return
+			}
+			w.Write(sig)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer mirror.Close()
+
+	update := func(c *Cache) error {
+		res := make(chan error)
+		if err := c.RefreshRepo(&repo, res); err != nil {
+			return err
+		}
+		return <-res
+	}
+	readDB := func() []byte {
+		db, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo+".db"))
+		assert.NoError(t, err)
+		return db
+	}
+
+	writeTestDB(t, dir, repo, _content, _filename)
+	db = readDB()
+	sig = sign(string(db))
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL)})
+	assert.NoError(t, err)
+	c.SetKeyring(keyring)
+
+	// Signed databases are cached
+	assert.NoError(t, update(c))
+	f, err := c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	data, cachedSig := readDBFile(t, f)
+	assert.Equal(t, db, data)
+	assert.Equal(t, sig, cachedSig)
+
+	// Databases with an invalid signature are quarantined and the old one
+	// is kept
+	oldDB := db
+	writeTestDB(t, dir, repo, _content, _filename, "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz")
+	db = readDB()
+	modTime = modTime.Add(time.Minute)
+	assert.Error(t, update(c))
+	f, err = c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	data, _ = readDBFile(t, f)
+	assert.Equal(t, oldDB, data)
+	quarantined, err := ioutil.ReadFile(filepath.Join(cacheDir, quarantineDir, _arch, _repo+".db"))
+	assert.NoError(t, err)
+	assert.Equal(t, db, quarantined)
+
+	// Unsigned databases are cached without verification
+	sig = nil
+	assert.NoError(t, update(c))
+	f, err = c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	data, cachedSig = readDBFile(t, f)
+	assert.Equal(t, db, data)
+	assert.Nil(t, cachedSig)
+}
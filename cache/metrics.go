@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+// cacheMetrics holds the metrics collected by the cache
+type cacheMetrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	servedBytes     *prometheus.CounterVec
+	databaseUpdates *prometheus.CounterVec
+	mirrorErrors    *prometheus.CounterVec
+	mirrorLatency   *prometheus.HistogramVec
+	quarantined     *prometheus.CounterVec
+}
+
+// gaugeVecFunc is a labeled gauge whose values are collected on every scrape
+type gaugeVecFunc struct {
+	desc    *prometheus.Desc
+	collect func(emit func(float64, ...string))
+}
+
+func newGaugeVecFunc(name, help string, collect func(emit func(float64, ...string)), labels ...string) *gaugeVecFunc {
+	return &gaugeVecFunc{
+		desc:    prometheus.NewDesc(name, help, labels, nil),
+		collect: collect,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (g *gaugeVecFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *gaugeVecFunc) Collect(ch chan<- prometheus.Metric) {
+	g.collect(func(v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v, labels...)
+	})
+}
+
+// initMetrics creates the metrics of the cache and registers them
+func (c *Cache) initMetrics() {
+	m := &cacheMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smartmirror_packet_requests_total",
+			Help: "Number of packet requests by result (hit or miss).",
+		}, []string{"result"}),
+		servedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smartmirror_served_bytes_total",
+			Help: "Number of packet bytes served to clients by source (cache or upstream).",
+		}, []string{"source"}),
+		databaseUpdates: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smartmirror_database_updates_total",
+			Help: "Number of database updates by repository and result (updated, unchanged or error).",
+		}, []string{"repo", "result"}),
+		mirrorErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smartmirror_mirror_errors_total",
+			Help: "Number of failed requests and downloads by mirror.",
+		}, []string{"mirror"}),
+		mirrorLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "smartmirror_mirror_latency_seconds",
+			Help:    "Time until the response headers were received by mirror.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"mirror"}),
+		quarantined: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "smartmirror_quarantined_total",
+			Help: "Number of downloads failing the signature verification by kind (packet or database).",
+		}, []string{"kind"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.servedBytes,
+		m.databaseUpdates,
+		m.mirrorErrors,
+		m.mirrorLatency,
+		m.quarantined,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smartmirror_active_downloads",
+			Help: "Number of packets currently being downloaded.",
+		}, func() float64 {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return float64(len(c.downloads))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "smartmirror_background_queue_depth",
+			Help: "Number of background downloads waiting to be started.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&c.bgQueued))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "smartmirror_evictions_total",
+			Help: "Number of packets evicted from the cache.",
+		}, func() float64 {
+			return float64(c.Evictions())
+		}),
+		newGaugeVecFunc("smartmirror_cache_size_bytes",
+			"Size of the cached packets by repository.",
+			func(emit func(float64, ...string)) {
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				for repo, size := range c.repoSizes() {
+					emit(float64(size), repo.String())
+				}
+			}, "repo"),
+		newGaugeVecFunc("smartmirror_mirror_cooldown",
+			"Whether a mirror is in cooldown after repeated failures (1) or not (0).",
+			func(emit func(float64, ...string)) {
+				for _, s := range c.Mirrors() {
+					var v float64
+					if c.health.InCooldown(s.Mirror) {
+						v = 1
+					}
+					emit(v, string(s.Mirror))
+				}
+			}, "mirror"),
+		newGaugeVecFunc("smartmirror_mirror_throughput_bytes_per_second",
+			"Moving average of the download speed in bytes per second by mirror.",
+			func(emit func(float64, ...string)) {
+				for _, s := range c.Mirrors() {
+					emit(s.Throughput, string(s.Mirror))
+				}
+			}, "mirror"),
+	)
+
+	c.metrics = m
+}
+
+// Metrics returns a handler exposing all metrics collected by the cache
+func (c *Cache) Metrics() http.Handler {
+	return promhttp.HandlerFor(c.metrics.registry, promhttp.HandlerOpts{})
+}
+
+// mirrorFailed records a failed request or download from a mirror
+func (c *Cache) mirrorFailed(mirror mirrorlist.Mirror, err error) {
+	c.metrics.mirrorErrors.WithLabelValues(string(mirror)).Inc()
+	c.health.RecordFailure(mirror, err)
+}
+
+// countingReadSeekCloser counts the bytes read from a ReadSeekCloser
+type countingReadSeekCloser struct {
+	ReadSeekCloser
+	counter prometheus.Counter
+}
+
+func (c *countingReadSeekCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadSeekCloser.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// countServed wraps r so all bytes read from it are counted as served from source
+func (c *Cache) countServed(r ReadSeekCloser, source string) ReadSeekCloser {
+	return &countingReadSeekCloser{r, c.metrics.servedBytes.WithLabelValues(source)}
+}
+
+// countingWriter counts the bytes written to a writer
+type countingWriter struct {
+	io.Writer
+	counter prometheus.Counter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
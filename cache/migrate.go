@@ -1,12 +1,9 @@
 package cache
 
 import (
-	"bufio"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 
 	"github.com/pkg/errors"
 	"github.com/veecue/pacman-smartmirror/database"
@@ -17,13 +14,15 @@ func (c *Cache) migrate(toMigrate []*packet.Packet) error {
 	if len(toMigrate) > 0 {
 		log.Println("Starting migration of", len(toMigrate), "packages...")
 	}
-	sizes := make(map[packet.Packet]string)
+	sizes := make(map[packet.Packet]int64)
+	infos := make(map[packet.Packet]os.FileInfo)
 	for _, p := range toMigrate {
 		fi, err := os.Stat(filepath.Join(c.directory, p.Filename()))
 		if err != nil {
 			return errors.Wrapf(err, "Error stating %s", p.Filename())
 		}
-		sizes[*p] = strconv.FormatInt(fi.Size(), 10)
+		sizes[*p] = fi.Size()
+		infos[*p] = fi
 	}
 
 	type hasRepo struct {
@@ -31,44 +30,25 @@ func (c *Cache) migrate(toMigrate []*packet.Packet) error {
 		B bool
 	}
 	cache := make(map[packet.Packet]*hasRepo)
-	for repo := range c.repos {
-		err := database.ParseDBFromFile(filepath.Join(c.directory, repo.Arch, repo.Name+".db"),
-			func(p *packet.Packet, r io.Reader) {
-				size, ok := sizes[*p]
-				if !ok {
-					return
-				}
-				br := bufio.NewReader(r)
-				for {
-					line, err := br.ReadString('\n')
-					if err != nil {
-						break
-					}
-					if line == "%CSIZE%\n" {
-						line, err = br.ReadString('\n')
-						if err != nil {
-							break
-						}
-						if line == size+"\n" {
-							// Found candidate
-							if cached, ok := cache[*p]; ok {
-								// Double match, discarding
-								cached.B = false
-								log.Printf("Double match for %s: found in %s and %s with size %s",
-									p.Filename(), cached.R, repo, size)
-								break
-							}
-							cache[*p] = &hasRepo{
-								R: repo,
-								B: true,
-							}
-						}
-						break
-					}
-				}
-			})
-		if err != nil {
-			return errors.Wrapf(err, "Error opening %s", filepath.Join(repo.Arch, repo.Name+".db"))
+	for repo, index := range c.indexes {
+		for p, size := range sizes {
+			info := index.ByFilename(p.Filename())
+			if info == nil || info.CSize != size {
+				continue
+			}
+
+			// Found candidate
+			if cached, ok := cache[p]; ok {
+				// Double match, discarding
+				cached.B = false
+				log.Printf("Double match for %s: found in %s and %s with size %d",
+					p.Filename(), cached.R, repo, size)
+				continue
+			}
+			cache[p] = &hasRepo{
+				R: repo,
+				B: true,
+			}
 		}
 	}
 
@@ -88,12 +68,26 @@ func (c *Cache) migrate(toMigrate []*packet.Packet) error {
 				return errors.Wrapf(err, "Error moving %s", p.Filename())
 			}
 
+			size := infos[p].Size()
+			err = os.Rename(
+				filepath.Join(c.directory, p.Filename()+".sig"),
+				filepath.Join(c.directory, has.R.Arch, has.R.Name, p.Filename()+".sig"))
+			if err == nil {
+				if fi, err := os.Stat(filepath.Join(c.directory, has.R.Arch, has.R.Name, p.Filename()+".sig")); err == nil {
+					size += fi.Size()
+				}
+			} else if !os.IsNotExist(err) {
+				return errors.Wrapf(err, "Error moving signature of %s", p.Filename())
+			}
+
 			c.mu.Lock()
 			if _, ok := c.packets[has.R]; !ok {
 				c.packets[has.R] = make(packet.Set)
 			}
 
-			c.packets[has.R].Insert(&p)
+			migrated := p
+			c.packets[has.R].Insert(&migrated)
+			c.track(&migrated, has.R, size, infos[p].ModTime())
 			c.mu.Unlock()
 		}
 	}
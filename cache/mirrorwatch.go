@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+// fileVersion identifies the content of a file without reading it
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func statVersions(filenames []string) []fileVersion {
+	versions := make([]fileVersion, len(filenames))
+	for i, filename := range filenames {
+		if stat, err := os.Stat(filename); err == nil {
+			versions[i] = fileVersion{stat.ModTime(), stat.Size(), true}
+		}
+	}
+
+	return versions
+}
+
+func versionsEqual(a, b []fileVersion) bool {
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size || a[i].exists != b[i].exists {
+			return false
+		}
+	}
+
+	return len(a) == len(b)
+}
+
+// WatchMirrorlists polls the modification times of the given mirrorlist files
+// and replaces the mirrors with their combined servers once they change. The
+// mirrorlists of the current routes are watched the same way and replace the
+// mirrors of their route. The current mirrors are kept if the files are
+// invalid or contain no servers. Ongoing downloads aren't affected. A
+// previous watch is stopped, the watch ends when the cache is closed. An
+// interval of 0 only stops the previous watch.
+func (c *Cache) WatchMirrorlists(filenames []string, interval time.Duration) {
+	ctx, cancel := context.WithCancel(c.ctx)
+
+	c.settingsMu.Lock()
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	c.stopWatch = cancel
+	routes := c.routes
+	c.settingsMu.Unlock()
+
+	if interval <= 0 {
+		cancel()
+		return
+	}
+
+	versions := statVersions(filenames)
+	routeVersions := make([][]fileVersion, len(routes))
+	for i := range routes {
+		routeVersions[i] = statVersions(routes[i].Mirrorlists)
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			current := statVersions(filenames)
+			if !versionsEqual(versions, current) {
+				versions = current
+				if err := c.reloadMirrorlists(filenames); err != nil {
+					log.Println("Keeping the current mirrors:", err)
+				}
+			}
+
+			for i := range routes {
+				current := statVersions(routes[i].Mirrorlists)
+				if versionsEqual(routeVersions[i], current) {
+					continue
+				}
+				routeVersions[i] = current
+				if err := c.reloadRoute(&routes[i]); err != nil {
+					log.Println("Keeping the current mirrors of the route:", err)
+				}
+			}
+		}
+	}()
+}
+
+// reloadMirrorlists reads the mirrorlist files and replaces the mirrors if
+// they are valid
+func (c *Cache) reloadMirrorlists(filenames []string) error {
+	m, err := mirrorlist.FromFiles(filenames...)
+	if err != nil {
+		return err
+	}
+	if len(m) == 0 {
+		return errors.Errorf("Mirrorlists %q contain no servers", filenames)
+	}
+
+	c.SetMirrors(m)
+	log.Printf("Reloaded mirrorlists %q with %d mirrors", filenames, len(m))
+	return nil
+}
+
+// reloadRoute reads the mirrorlist files of the route and replaces the
+// mirrors of the routes with the same source if they are valid
+func (c *Cache) reloadRoute(route *Route) error {
+	m, err := mirrorlist.FromFiles(route.Mirrorlists...)
+	if err != nil {
+		return err
+	}
+	// The servers of the route don't make up for an empty mirrorlist
+	if len(m) == 0 {
+		return errors.Errorf("Mirrorlists %q contain no servers", route.Mirrorlists)
+	}
+	m = append(m, route.Servers...)
+
+	// The routes are shared with the caller of SetRoutes, so they are
+	// copied instead of changed in place
+	c.settingsMu.Lock()
+	routes := make([]Route, len(c.routes))
+	copy(routes, c.routes)
+	for i := range routes {
+		if routes[i].sameSource(route) {
+			routes[i].Mirrors = m
+		}
+	}
+	c.routes = routes
+	c.settingsMu.Unlock()
+
+	log.Printf("Reloaded mirrorlists %q of a route with %d mirrors", route.Mirrorlists, len(m))
+	return nil
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+func TestWatchMirrorlists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	filename := filepath.Join(dir, "mirrorlist")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+		// Make sure the change is noticed regardless of the timestamp
+		// resolution of the filesystem
+		modTime = modTime.Add(time.Second)
+		assert.NoError(t, os.Chtimes(filename, modTime, modTime))
+	}
+	write("Server = http://a/$repo/os/$arch\n")
+
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{"http://a/$repo/os/$arch"})
+	assert.NoError(t, err)
+	defer c.Close(context.Background())
+	c.WatchMirrorlists([]string{filename}, 5*time.Millisecond)
+
+	write("Server = http://b/$repo/os/$arch\nServer = http://c/$repo/os/$arch\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, mirrorlist.Mirrorlist{"http://b/$repo/os/$arch", "http://c/$repo/os/$arch"}, c.getMirrors())
+
+	// Empty and missing mirrorlists are ignored
+	write("# no servers\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, len(c.getMirrors()))
+
+	assert.NoError(t, os.Remove(filename))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, len(c.getMirrors()))
+}
+
+func TestWatchRouteMirrorlists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	filename := filepath.Join(dir, "mirrorlist-arm")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(content string) {
+		assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+		modTime = modTime.Add(time.Second)
+		assert.NoError(t, os.Chtimes(filename, modTime, modTime))
+	}
+	write("Server = http://a/$arch/$repo\n")
+
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{"http://default/$repo/os/$arch"})
+	assert.NoError(t, err)
+	defer c.Close(context.Background())
+	c.SetRoutes([]Route{{
+		Arch:        "aarch64",
+		Mirrors:     mirrorlist.Mirrorlist{"http://a/$arch/$repo", "http://s/$arch/$repo"},
+		Mirrorlists: []string{filename},
+		Servers:     mirrorlist.Mirrorlist{"http://s/$arch/$repo"},
+	}})
+	c.WatchMirrorlists(nil, 5*time.Millisecond)
+
+	// The mirrors of the route are replaced, its servers are kept
+	repo := database.Repository{Name: "core", Arch: "aarch64"}
+	write("Server = http://b/$arch/$repo\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, mirrorlist.Mirrorlist{"http://b/$arch/$repo", "http://s/$arch/$repo"}, c.mirrorsFor(&repo))
+	assert.Equal(t, mirrorlist.Mirrorlist{"http://default/$repo/os/$arch"}, c.getMirrors())
+
+	// Empty and invalid mirrorlists keep the current mirrors
+	write("# no servers\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, mirrorlist.Mirrorlist{"http://b/$arch/$repo", "http://s/$arch/$repo"}, c.mirrorsFor(&repo))
+
+	assert.NoError(t, os.Remove(filename))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, mirrorlist.Mirrorlist{"http://b/$arch/$repo", "http://s/$arch/$repo"}, c.mirrorsFor(&repo))
+}
@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -9,87 +11,142 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
 	"github.com/veecue/pacman-smartmirror/packet"
 )
 
-// checks if the given repository is already in the repository cache and downloads
-// it asynchronously. If the function returns no immediate error (nil), it will write
-// the final error to the channel if the channel is not nil.
-func (c *Cache) addRepo(repo *database.Repository, result chan<- error) error {
+// artifactSet holds the cached artifacts of a repository
+type artifactSet map[database.Artifact]struct{}
+
+// repoFile identifies an artifact of a repository
+type repoFile struct {
+	repo     database.Repository
+	artifact database.Artifact
+}
+
+// repoPath returns the path of an artifact of a repository in the cache
+func (c *Cache) repoPath(repo *database.Repository, artifact database.Artifact) string {
+	return filepath.Join(c.directory, repo.Arch, artifact.Filename(repo))
+}
+
+// hasArtifact reports whether the artifact of the repository is cached,
+// c.repoMu has to be held
+func (c *Cache) hasArtifact(repo *database.Repository, artifact database.Artifact) bool {
+	_, ok := c.repos[*repo][artifact]
+	return ok
+}
+
+// checks if the given artifact of a repository is already in the repository cache
+// and downloads it asynchronously. If the function returns no immediate error (nil),
+// it will write the final error to the channel if the channel is not nil.
+func (c *Cache) addRepo(repo *database.Repository, artifact database.Artifact, result chan<- error) error {
 	c.repoMu.Lock()
-	_, ok := c.repos[*repo]
+	ok := c.hasArtifact(repo, artifact)
 	c.repoMu.Unlock()
 	if ok {
 		return errors.New("Repo already available")
 	}
 
-	log.Println("Downloading repo", repo)
-	err := c.downloadRepo(repo, result)
+	log.Println("Downloading", artifact.Filename(repo), "of", repo)
+	err := c.downloadRepo(c.ctx, repo, artifact, result)
 	if err == nil {
-		log.Println("Repo", repo, "now available")
+		log.Println(artifact.Filename(repo), "of", repo, "now available")
 	} else {
-		log.Println("Error downloading", repo, err)
+		log.Println("Error downloading", artifact.Filename(repo), "of", repo, err)
 	}
 
 	return err
 }
 
-// downloadRepo will download the database file of the given repository and add
+// downloadRepo will download the given artifact of the given repository and add
 // it to the repository cache. If no immediate error occurs (nil is returned),
 // the final error will be pushed to the given channel if the channel is not nil.
-func (c *Cache) downloadRepo(repo *database.Repository, result chan<- error) error {
+// The download is aborted once ctx is done.
+func (c *Cache) downloadRepo(ctx context.Context, repo *database.Repository, artifact database.Artifact, result chan<- error) error {
 	callback := func(err error) {
 		if result != nil {
 			result <- err
 		}
 	}
+	updates := func(result string) prometheus.Counter {
+		return c.metrics.databaseUpdates.WithLabelValues(repo.String(), result)
+	}
 
 	c.repoMu.Lock()
-	defer c.repoMu.Unlock()
-
-	if _, ok := c.repoDownloads[*repo]; ok {
+	key := repoFile{*repo, artifact}
+	if _, ok := c.repoDownloads[key]; ok {
+		c.repoMu.Unlock()
 		return errors.New("Repo is already being downloaded")
 	}
 
-	file := filepath.Join(c.directory, repo.Arch, repo.Name+".db")
+	if c.closed {
+		c.repoMu.Unlock()
+		return ErrClosed
+	}
+
+	file := c.repoPath(repo, artifact)
+
+	// In staged mode a new database doesn't replace the live one right
+	// away, it is kept next to it until the packets are downloaded
+	target := file
+	if artifact == database.DB && c.hasArtifact(repo, artifact) && c.Policy(repo).Staged {
+		target += stagedSuffix
+	}
 
 	// Send the modtime of the cached file to the server so only a later
 	// version is downloaded.
 	var modTime *time.Time
-	if _, ok := c.repos[*repo]; ok {
-		stat, err := os.Stat(file)
+	if c.hasArtifact(repo, artifact) {
+		latest := file
+		if artifact == database.DB && c.isStaging(repo) {
+			latest += stagedSuffix
+		}
+		stat, err := os.Stat(latest)
 		if err == nil {
 			t := stat.ModTime()
 			modTime = &t
 		}
 	}
 
-	for _, mirror := range c.mirrors {
-		req, _ := http.NewRequest("GET", mirror.RepoURL(repo), nil)
+	// Reserve the download so c.repoMu isn't held while the mirrors are
+	// requested. The reservation ends with the download or with release if
+	// none is started.
+	c.repoDownloads[key] = struct{}{}
+	c.wg.Add(1)
+	c.repoMu.Unlock()
+	release := func() {
+		c.repoMu.Lock()
+		delete(c.repoDownloads, key)
+		c.repoMu.Unlock()
+		c.wg.Done()
+	}
+
+	for _, mirror := range c.rankedMirrors(repo) {
+		req, _ := http.NewRequest("GET", mirror.ArtifactURL(repo, artifact), nil)
 
-		req.Header.Set("User-Agent", "pacman-smartmirror/0.0")
 		if modTime != nil {
 			req.Header.Set("If-Modified-Since", modTime.Format(http.TimeFormat))
 		}
 
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := c.do(ctx, req, mirror)
 		if err != nil {
 			//TODO: log?
 			continue
 		}
 
 		if resp.StatusCode == 304 {
-			log.Println("Database", repo, "already up to date")
+			resp.Body.Close()
+			log.Println(artifact.Filename(repo), "of", repo, "already up to date")
+			updates("unchanged").Inc()
+			release()
 			go callback(nil)
 			return nil
 		}
 
-		if resp.StatusCode != 200 {
-			continue
-		}
-
-		if resp.ContentLength <= 0 {
+		if resp.StatusCode != 200 || resp.ContentLength <= 0 {
+			resp.Body.Close()
 			continue
 		}
 
@@ -101,57 +158,136 @@ func (c *Cache) downloadRepo(repo *database.Repository, result chan<- error) err
 
 		// Cancel download if the file given by the server is older than the local file
 		if modTime != nil && serverModTime != nil && (modTime.After(*serverModTime) || modTime.Equal(*serverModTime)) {
-			log.Println("Database", repo, "already up to date")
+			resp.Body.Close()
+			log.Println(artifact.Filename(repo), "of", repo, "already up to date")
+			updates("unchanged").Inc()
+			release()
 			go callback(nil)
 			return nil
 		}
 
 		err = os.Mkdir(filepath.Join(c.directory, repo.Arch), 0755)
 		if err != nil && !os.IsExist(err) {
+			resp.Body.Close()
 			err = errors.Wrap(err, "Error creating cache dir")
 			log.Println(err)
+			updates("error").Inc()
+			release()
 			return err
 		}
 
 		// Create the temporary file to store the download
 		f, err := os.Create(file + ".part")
 		if err != nil {
+			resp.Body.Close()
 			err = errors.Wrap(err, "Error creating repo file")
 			log.Println(err)
+			updates("error").Inc()
+			release()
 			return err
 		}
 
-		c.repoDownloads[*repo] = struct{}{}
-
 		go func() {
-			_, err := io.CopyN(f, resp.Body, resp.ContentLength)
+			defer c.wg.Done()
+			start := time.Now()
+			n, err := io.CopyN(f, resp.Body, resp.ContentLength)
+			f.Close()
+			resp.Body.Close()
+			c.health.RecordTransfer(mirror, n, time.Since(start))
+
+			var index *database.Index
 			if err != nil {
 				err = errors.Wrap(err, "Error downloading repo file")
-				log.Println(err)
-				os.Remove(file + ".part")
-				callback(err)
-				return
+			} else {
+				// Parse the database before using it so a broken download
+				// never replaces a working database. The files database
+				// holds the same metadata and is checked the same way.
+				index, err = database.IndexFromFile(file + ".part")
+				err = errors.Wrap(err, "Error parsing repo file")
+			}
+
+			// The signature has to come from the same mirror to match
+			var sig []byte
+			if err == nil {
+				sig, err = c.fetchRepoSignature(ctx, mirror, repo, artifact)
+			}
+			// The official databases are unsigned, so only databases
+			// coming with a signature are verified
+			var untrusted bool
+			if keyring := c.getKeyring(); err == nil && keyring != nil && sig != nil {
+				err = errors.Wrapf(verifyFile(keyring, file+".part", sig), "Error verifying %s", artifact.Filename(repo))
+				untrusted = err != nil
+			}
+			if err == nil && sig != nil {
+				err = errors.Wrap(ioutil.WriteFile(file+".sig.part", sig, 0644), "Error writing signature")
 			}
 
 			c.repoMu.Lock()
 			defer c.repoMu.Unlock()
+			delete(c.repoDownloads, key)
 
-			os.Remove(file)
-			err = os.Rename(file+".part", file)
+			if err != nil {
+				log.Println(err)
+				if untrusted {
+					c.quarantine(file+".part", filepath.Join(repo.Arch, artifact.Filename(repo)), sig, "database")
+				} else {
+					os.Remove(file + ".part")
+				}
+				os.Remove(file + ".sig.part")
+				c.mirrorFailed(mirror, err)
+				updates("error").Inc()
+				callback(err)
+				return
+			}
+
+			// Both files are replaced while holding c.repoMu so the
+			// database and its signature are always read as a pair
+			var archived string
+			if target == file && artifact == database.DB {
+				archived = c.archiveDB(repo)
+			}
+			os.Remove(target)
+			err = os.Rename(file+".part", target)
 			if err != nil {
 				err = errors.Wrap(err, "Error moving repo file")
 				log.Println(err)
 				os.Remove(file + ".part")
+				os.Remove(file + ".sig.part")
+				if archived != "" {
+					c.unarchiveDB(repo, archived)
+				} else {
+					os.Remove(target + ".sig")
+				}
+				updates("error").Inc()
 				callback(err)
 				return
 			}
 
+			os.Remove(target + ".sig")
+			if sig != nil {
+				if err := os.Rename(file+".sig.part", target+".sig"); err != nil {
+					log.Println(errors.Wrap(err, "Error moving signature"))
+					os.Remove(file + ".sig.part")
+				}
+			}
+
 			if serverModTime != nil {
-				os.Chtimes(file, time.Now(), *serverModTime)
+				os.Chtimes(target, time.Now(), *serverModTime)
 			}
 
-			c.repos[*repo] = struct{}{}
-			delete(c.repoDownloads, *repo)
+			switch {
+			case target != file:
+				log.Println("Staged new", artifact.Filename(repo), "of", repo)
+				c.staged[*repo] = index
+			case artifact == database.DB:
+				c.discardStaged(repo)
+				c.indexes[*repo] = index
+			}
+			if c.repos[*repo] == nil {
+				c.repos[*repo] = make(artifactSet)
+			}
+			c.repos[*repo][artifact] = struct{}{}
+			updates("updated").Inc()
 
 			callback(err)
 		}()
@@ -159,79 +295,193 @@ func (c *Cache) downloadRepo(repo *database.Repository, result chan<- error) err
 		return nil
 	}
 
+	updates("error").Inc()
+	release()
 	return errors.New("Database could not be downloaded from any mirror")
 }
 
-// updatePackets will update all locally cached packages that are part of the given repository
+// fetchRepoSignature downloads the signature of an artifact of a repository
+// from the given mirror. Returns nil without an error if the mirror has no
+// signature.
+func (c *Cache) fetchRepoSignature(ctx context.Context, mirror mirrorlist.Mirror, repo *database.Repository, artifact database.Artifact) ([]byte, error) {
+	req, _ := http.NewRequest("GET", mirror.ArtifactURL(repo, artifact)+".sig", nil)
+	resp, err := c.do(ctx, req, mirror)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error downloading signature")
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case 200:
+	case 404:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("Error downloading signature: %s", resp.Status)
+	}
+
+	sig, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	return sig, errors.Wrap(err, "Error downloading signature")
+}
+
+// updatePackets will update all locally cached packages that are part of the given repository.
+// A staged database of the repository is used and made live once all of them are available.
 func (c *Cache) updatePackets(repo database.Repository) {
-	// List of packages that are out of date
-	toDownload := make([]*packet.Packet, 0)
-	err := database.ParseDBFromFile(filepath.Join(c.directory, repo.Arch, repo.Name+".db"), func(p *packet.Packet, _ io.Reader) {
-		c.mu.Lock()
-		for _, other := range c.packets[repo].FindOtherVersions(p) {
-			if packet.CompareVersions(p.Version, other.Version) > 0 {
-				// Version in the repository is later than the local one
-				toDownload = append(toDownload, p)
-				break
+	index := c.stagedIndex(&repo)
+	staged := index != nil
+	if !staged {
+		index = c.Index(&repo)
+	}
+
+	if c.Policy(&repo).NoPrefetch {
+		// There are no packets to wait for
+		if staged {
+			if err := c.promoteStaged(repo, index); err != nil {
+				log.Println(err)
 			}
 		}
-		c.mu.Unlock()
-	})
+		return
+	}
 
-	if err != nil {
-		log.Println("Error parsing db file:", err)
+	// List of packages that are out of date
+	toDownload := make(packet.Set)
+	if index == nil {
+		log.Println("No database index for", repo)
 		return
 	}
 
+	c.mu.Lock()
+	for _, cached := range c.packets[repo] {
+		info := index.ByName(cached.Name)
+		if info == nil {
+			continue
+		}
+
+		p, err := info.Packet()
+		if err != nil || p.Arch != cached.Arch {
+			continue
+		}
+
+		if packet.CompareVersions(p.Version, cached.Version) > 0 && c.packets[repo].ByFilename(p.Filename()) == nil {
+			// Version in the repository is later than the local one
+			toDownload.Insert(p)
+		}
+	}
+	c.mu.Unlock()
+
 	// Update all outdated packages
 	for _, p := range toDownload {
-		if c.backgroundDownload(&download{*p, repo, nil}) == nil {
-			if err != nil {
-				log.Println(errors.Wrapf(err, "Error downloading %s", p.Filename()))
-			}
+		err := c.backgroundDownload(&download{*p, repo, nil})
+		if err != nil {
+			log.Println(errors.Wrapf(err, "Error downloading %s", p.Filename()))
+		}
+	}
+
+	if !staged {
+		log.Println("All cached packages for", repo, "up to date")
+		return
+	}
+
+	missing := 0
+	c.mu.Lock()
+	for _, p := range toDownload {
+		if c.packets[repo].ByFilename(p.Filename()) == nil {
+			missing++
 		}
 	}
+	c.mu.Unlock()
+	if missing > 0 {
+		log.Printf("Keeping the previous database of %s, %d packets are missing", repo, missing)
+		return
+	}
 
-	log.Println("All cached packages for", repo, "up to date")
+	if err := c.promoteStaged(repo, index); err != nil {
+		log.Println(err)
+	}
 }
 
-// GetDBFile returns the latest cached version of a given database together with
-// the time it was updated.
-func (c *Cache) GetDBFile(repo *database.Repository) (ReadSeekCloser, time.Time, error) {
-	if _, ok := c.repos[*repo]; ok {
-		c.repoMu.Lock()
-		defer c.repoMu.Unlock()
+// Index returns the index of the latest cached version of the given database
+// or nil if the database isn't cached
+func (c *Cache) Index(repo *database.Repository) *database.Index {
+	c.repoMu.Lock()
+	defer c.repoMu.Unlock()
 
-		path := filepath.Join(c.directory, repo.Arch, repo.Name+".db")
-		file, err := os.Open(path)
-		if err != nil {
-			return nil, time.Time{}, errors.Wrap(err, "Error opening repository file")
-		}
+	return c.indexes[*repo]
+}
 
-		modtime := time.Time{}
-		if stat, err := os.Stat(path); err == nil {
-			modtime = stat.ModTime()
-		}
+// DBFile is a cached artifact of a repository with its signature
+type DBFile struct {
+	File ReadSeekCloser
+	// Signature is nil if the mirror didn't provide one
+	Signature ReadSeekCloser
+	// ModTime is the time the artifact was updated on the mirror
+	ModTime time.Time
+}
 
-		return file, modtime, nil
+// Close closes the artifact and its signature
+func (f *DBFile) Close() error {
+	if f.Signature != nil {
+		f.Signature.Close()
 	}
 
-	return nil, time.Time{}, errors.New("Database file not found")
+	return f.File.Close()
 }
 
-// ProxyRepo will proxy the given repository database file from a mirror
-// with out downloading it to the cache.
-func (c *Cache) ProxyRepo(w http.ResponseWriter, r *http.Request, repo *database.Repository) {
-	for _, mirror := range c.mirrors {
-		req, _ := http.NewRequest("GET", mirror.RepoURL(repo), nil)
+// GetDBFile returns the latest cached version of the given artifact of a
+// repository together with its matching signature. Missing artifacts are
+// downloaded in the background.
+func (c *Cache) GetDBFile(repo *database.Repository, artifact database.Artifact) (*DBFile, error) {
+	c.repoMu.Lock()
+	defer c.repoMu.Unlock()
+
+	if !c.hasArtifact(repo, artifact) {
+		go c.addRepo(repo, artifact, nil)
+		return nil, errors.New("Database file not found")
+	}
+
+	path := c.repoPath(repo, artifact)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error opening repository file")
+	}
+
+	dbFile := &DBFile{File: file}
+	if stat, err := file.Stat(); err == nil {
+		dbFile.ModTime = stat.ModTime()
+	}
+
+	sig, err := os.Open(path + ".sig")
+	if err == nil {
+		dbFile.Signature = sig
+	} else if !os.IsNotExist(err) {
+		file.Close()
+		return nil, errors.Wrap(err, "Error opening repository signature")
+	}
+
+	return dbFile, nil
+}
+
+// ProxyRepo will proxy the given artifact of a repository or its signature
+// from a mirror with out downloading it to the cache.
+func (c *Cache) ProxyRepo(w http.ResponseWriter, r *http.Request, repo *database.Repository, artifact database.Artifact, signature bool) {
+	mirrors := c.rankedMirrors(repo)
+	missing := 0
+	for _, mirror := range mirrors {
+		url := mirror.ArtifactURL(repo, artifact)
+		if signature {
+			url += ".sig"
+		}
+		req, _ := http.NewRequest("GET", url, nil)
 		req.Header = r.Header
-		req.Header.Set("User-Agent", "pacman-smartmirror/0.0")
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := c.do(r.Context(), req, mirror)
 		if err != nil {
 			continue
 		}
 
 		if resp.StatusCode != 200 && resp.StatusCode != 304 {
+			if resp.StatusCode == 404 {
+				missing++
+			}
+			resp.Body.Close()
 			continue
 		}
 
@@ -240,11 +490,44 @@ func (c *Cache) ProxyRepo(w http.ResponseWriter, r *http.Request, repo *database
 			w.Header().Add(key, resp.Header.Get(key))
 		}
 		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		io.Copy(&countingWriter{w, c.metrics.servedBytes.WithLabelValues("upstream")}, resp.Body)
+		resp.Body.Close()
 		return
 	}
 
-	http.NotFound(w, r)
+	if notFoundOr(missing, mirrors, nil) == ErrNotFound {
+		http.Error(w, "Database not found on any mirror", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "Database could not be downloaded from any mirror", http.StatusBadGateway)
+}
+
+// refreshArtifacts downloads the latest versions of the cached artifacts of
+// the given repository besides its database one after another. Returns the
+// last error.
+func (c *Cache) refreshArtifacts(repo database.Repository) error {
+	c.repoMu.Lock()
+	artifacts := make([]database.Artifact, 0)
+	for _, artifact := range database.Artifacts {
+		if artifact != database.DB && c.hasArtifact(&repo, artifact) {
+			artifacts = append(artifacts, artifact)
+		}
+	}
+	c.repoMu.Unlock()
+
+	var lastErr error
+	result := make(chan error)
+	for _, artifact := range artifacts {
+		err := c.downloadRepo(c.ctx, &repo, artifact, result)
+		if err == nil {
+			err = <-result
+		}
+		if err != nil {
+			lastErr = errors.Wrapf(err, "Error updating %s", artifact.Filename(&repo))
+		}
+	}
+
+	return lastErr
 }
 
 // UpdateDatabases will update all cached database files in the background
@@ -257,7 +540,9 @@ func (c *Cache) UpdateDatabases(result chan<- error) {
 	toUpdate := make([]database.Repository, 0)
 	c.repoMu.Lock()
 	for repo := range c.repos {
-		toUpdate = append(toUpdate, repo)
+		if !c.Policy(&repo).Disabled {
+			toUpdate = append(toUpdate, repo)
+		}
 	}
 	c.repoMu.Unlock()
 
@@ -266,21 +551,23 @@ func (c *Cache) UpdateDatabases(result chan<- error) {
 		subresults := make(chan error)
 		for _, repo := range toUpdate {
 			log.Println("Updating", repo)
-			err := c.downloadRepo(&repo, subresults)
+			err := c.downloadRepo(c.ctx, &repo, database.DB, subresults)
+			if err == nil {
+				err = <-subresults
+				go c.updatePackets(repo)
+			}
 			if err != nil {
 				lastErr = errors.Wrap(err, "Error updating databases")
 				log.Println(lastErr)
-				continue
 			}
 
-			err = <-subresults
-			if err != nil {
+			if err := c.refreshArtifacts(repo); err != nil {
 				lastErr = errors.Wrap(err, "Error updating databases")
 				log.Println(lastErr)
 			}
-
-			go c.updatePackets(repo)
 		}
+		c.pruneArchive(time.Now())
+
 		if lastErr == nil {
 			log.Println("All databases updated successfully")
 		} else {
@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+// readDBFile reads the content and the signature of a cached artifact
+func readDBFile(t *testing.T, f *DBFile) ([]byte, []byte) {
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f.File)
+	assert.NoError(t, err)
+	if f.Signature == nil {
+		return data, nil
+	}
+
+	sig, err := ioutil.ReadAll(f.Signature)
+	assert.NoError(t, err)
+	return data, sig
+}
+
+// waitDBFile waits until the artifact is cached and returns its content and
+// modification time
+func waitDBFile(t *testing.T, c *Cache, repo *database.Repository, artifact database.Artifact) ([]byte, time.Time) {
+	for i := 0; i < 1000; i++ {
+		f, err := c.GetDBFile(repo, artifact)
+		if err == nil {
+			data, _ := readDBFile(t, f)
+			return data, f.ModTime
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Fail(t, "Database file not cached in time")
+	return nil, time.Time{}
+}
+
+func TestArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	mirrorDir := filepath.Join(dir, "mirror")
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+
+	// The files database holds the same metadata as the database
+	writeTestDB(t, mirrorDir, repo, _content, _filename)
+	db := filepath.Join(mirrorDir, _arch, _repo+".db")
+	files := filepath.Join(mirrorDir, _arch, _repo+".files")
+	data, err := ioutil.ReadFile(db)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(files, data, 0644))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(files, modTime, modTime))
+
+	mirrors := mirrorlist.Mirrorlist{mirrorlist.Mirror("file://" + mirrorDir + "/$arch")}
+	c, err := New(cacheDir, mirrors)
+	assert.NoError(t, err)
+
+	// Missing artifacts are downloaded in the background
+	_, err = c.GetDBFile(&repo, database.Files)
+	assert.Error(t, err)
+	cached, cachedTime := waitDBFile(t, c, &repo, database.Files)
+	assert.Equal(t, data, cached)
+	assert.True(t, modTime.Equal(cachedTime), cachedTime)
+
+	// Updates include all cached artifacts
+	writeTestDB(t, mirrorDir, repo, _content, _filename, "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz")
+	data, err = ioutil.ReadFile(db)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(files, data, 0644))
+	res := make(chan error)
+	c.UpdateDatabases(res)
+	assert.NoError(t, <-res)
+	cached, cachedTime = waitDBFile(t, c, &repo, database.Files)
+	assert.Equal(t, data, cached)
+	assert.True(t, cachedTime.After(modTime))
+	assert.NotNil(t, c.Index(&repo).ByFilename("xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz"))
+
+	// All artifacts are found when restarting
+	c, err = New(cacheDir, mirrors)
+	assert.NoError(t, err)
+	c.repoMu.Lock()
+	assert.Equal(t, artifactSet{database.DB: {}, database.Files: {}}, c.repos[repo])
+	c.repoMu.Unlock()
+}
+
+func TestDBSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	var db []byte
+	var sig string
+	var sigStatus int32 = 200
+	modTime := time.Now().Add(-time.Hour)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + _repo + ".db":
+			http.ServeContent(w, r, r.URL.Path, modTime, bytes.NewReader(db))
+		case "/" + _repo + ".db.sig":
+			if status := int(atomic.LoadInt32(&sigStatus)); status != 200 {
+				w.WriteHeader(status)
+				return
+			}
+			io.WriteString(w, sig)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer mirror.Close()
+
+	update := func(c *Cache) error {
+		res := make(chan error)
+		if err := c.RefreshRepo(&repo, res); err != nil {
+			return err
+		}
+		return <-res
+	}
+
+	writeTestDB(t, dir, repo, _content, _filename)
+	db, err = ioutil.ReadFile(filepath.Join(dir, _arch, _repo+".db"))
+	assert.NoError(t, err)
+	sig = "signature 1"
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL)})
+	assert.NoError(t, err)
+
+	// The database and its signature are downloaded together
+	assert.NoError(t, update(c))
+	f, err := c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	data, cachedSig := readDBFile(t, f)
+	assert.Equal(t, db, data)
+	assert.Equal(t, sig, string(cachedSig))
+
+	// A new database is only used together with its signature
+	oldDB := db
+	writeTestDB(t, dir, repo, _content, _filename, "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz")
+	db, err = ioutil.ReadFile(filepath.Join(dir, _arch, _repo+".db"))
+	assert.NoError(t, err)
+	sig = "signature 2"
+	modTime = modTime.Add(time.Minute)
+	atomic.StoreInt32(&sigStatus, 503)
+	assert.Error(t, update(c))
+	f, err = c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	data, cachedSig = readDBFile(t, f)
+	assert.Equal(t, oldDB, data)
+	assert.Equal(t, "signature 1", string(cachedSig))
+
+	atomic.StoreInt32(&sigStatus, 200)
+	assert.NoError(t, update(c))
+	f, err = c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	data, cachedSig = readDBFile(t, f)
+	assert.Equal(t, db, data)
+	assert.Equal(t, "signature 2", string(cachedSig))
+
+	// Signatures removed from the mirror are removed from the cache
+	modTime = modTime.Add(time.Minute)
+	atomic.StoreInt32(&sigStatus, 404)
+	assert.NoError(t, update(c))
+	f, err = c.GetDBFile(&repo, database.DB)
+	assert.NoError(t, err)
+	assert.Nil(t, f.Signature)
+	f.Close()
+}
+
+func TestSlowDBMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	writeTestDB(t, dir, repo, _content, _filename)
+	db, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo+".db"))
+	assert.NoError(t, err)
+
+	requested := make(chan struct{})
+	unblock := make(chan struct{})
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+_repo+".db" {
+			w.WriteHeader(404)
+			return
+		}
+		close(requested)
+		<-unblock
+		http.ServeContent(w, r, r.URL.Path, time.Now(), bytes.NewReader(db))
+	}))
+	defer mirror.Close()
+
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL)})
+	assert.NoError(t, err)
+
+	res := make(chan error, 1)
+	go func() {
+		res <- c.RefreshRepo(&repo, nil)
+	}()
+	<-requested
+
+	// The repositories can be inspected while a mirror is slow to respond
+	inspected := make(chan struct{})
+	go func() {
+		c.Repos()
+		c.Index(&repo)
+		close(inspected)
+	}()
+	select {
+	case <-inspected:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Repositories blocked by a database request")
+	}
+
+	close(unblock)
+	assert.NoError(t, <-res)
+	waitDBFile(t, c, &repo, database.DB)
+	assert.NoError(t, c.Close(context.Background()))
+}
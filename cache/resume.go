@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+)
+
+// verifiable reports whether a download can be verified with the given
+// metadata so that it can be safely resumed from any mirror
+func verifiable(info *database.PackageInfo) bool {
+	return info != nil && info.SHA256Sum != "" && info.CSize > 0
+}
+
+// validator returns the value to use in an If-Range header to make sure a
+// resumed download still refers to the same file: a strong ETag or the
+// modification time.
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return resp.Header.Get("Last-Modified")
+}
+
+// contentRange parses the Content-Range header of a partial response and
+// returns the first byte sent and the total size of the file
+func contentRange(resp *http.Response) (start int64, size int64, ok bool) {
+	cr := resp.Header.Get("Content-Range")
+	if !strings.HasPrefix(cr, "bytes ") {
+		return 0, 0, false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(cr, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	rng := strings.SplitN(parts[0], "-", 2)
+	if len(rng) != 2 {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(rng[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	end, err := strconv.ParseInt(rng[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	size, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || end != size-1 || start > end {
+		return 0, 0, false
+	}
+
+	return start, size, true
+}
+
+// hashPrefix feeds the first n bytes of the given file to h
+func hashPrefix(h hash.Hash, filename string, n int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrap(err, "Error opening partial file")
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(h, f, n)
+	return errors.Wrap(err, "Error reading partial file")
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/test"
+)
+
+var _bigContent = strings.Repeat("abcdefghij", 10000)
+
+// waitCached waits until the given packet has been added to the cache
+func waitCached(t *testing.T, c *Cache, repo database.Repository, filename string) {
+	for i := 0; i < 1000; i++ {
+		c.mu.Lock()
+		cached := c.packets[repo].ByFilename(filename)
+		c.mu.Unlock()
+		if cached != nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Fail(t, "Packet not cached in time")
+}
+
+func TestResumeInterrupted(t *testing.T) {
+	var calls int32
+	s := test.NewRequestServer(t, func(w http.ResponseWriter, r *http.Request, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			// Drop the connection after half of the file
+			assert.Equal(t, "", r.Header.Get("Range"))
+			w.Header().Set("Content-Length", strconv.Itoa(len(_bigContent)))
+			io.WriteString(w, _bigContent[:len(_bigContent)/2])
+			w.(http.Flusher).Flush()
+			return
+		}
+
+		assert.Equal(t, `"v1"`, r.Header.Get("If-Range"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Range"), "bytes="))
+		http.ServeContent(w, r, filename, time.Time{}, strings.NewReader(_bigContent))
+	})
+	defer s.StopServer(t)
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	c, err := New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(s.URL)})
+	assert.NoError(t, err)
+
+	repo := database.Repository{
+		Name: _repo,
+		Arch: _arch,
+	}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	var b bytes.Buffer
+	_, err = io.CopyN(&b, r, int64(len(_bigContent)))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, _bigContent, b.String())
+
+	waitCached(t, c, repo, _filename)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	content, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo, _filename))
+	assert.NoError(t, err)
+	assert.Equal(t, _bigContent, string(content))
+}
+
+func TestResumePartialFile(t *testing.T) {
+	const offset = 1000
+	var calls int32
+	s := test.NewRequestServer(t, func(w http.ResponseWriter, r *http.Request, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+
+		atomic.AddInt32(&calls, 1)
+		assert.Equal(t, "bytes="+strconv.Itoa(offset)+"-", r.Header.Get("Range"))
+		http.ServeContent(w, r, filename, time.Time{}, strings.NewReader(_bigContent))
+	})
+	defer s.StopServer(t)
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	repo := database.Repository{
+		Name: _repo,
+		Arch: _arch,
+	}
+	writeTestDB(t, dir, repo, _bigContent, _filename)
+
+	// Partial files that can't be verified are removed
+	const unverifiable = "zbar-0.23-1-x86_64.pkg.tar.xz.part"
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, _arch, _repo), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, _arch, _repo, _filename+".part"), []byte(_bigContent[:offset]), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, _arch, _repo, unverifiable), []byte(_bigContent[:offset]), 0644))
+
+	c, err := New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(s.URL)})
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, _arch, _repo, unverifiable))
+	assert.True(t, os.IsNotExist(err))
+
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	assert.Equal(t, len(_bigContent), getSize(t, r))
+	var b bytes.Buffer
+	_, err = io.CopyN(&b, r, int64(len(_bigContent)))
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, _bigContent, b.String())
+
+	waitCached(t, c, repo, _filename)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	content, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo, _filename))
+	assert.NoError(t, err)
+	assert.Equal(t, _bigContent, string(content))
+}
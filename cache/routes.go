@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"reflect"
+
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+// Route selects the mirrors of the repositories it matches. Empty fields
+// match any value.
+type Route struct {
+	Repo    string
+	Arch    string
+	Mirrors mirrorlist.Mirrorlist
+	// Mirrorlists are the files Mirrors were read from followed by Servers,
+	// they are watched by WatchMirrorlists
+	Mirrorlists []string
+	Servers     mirrorlist.Mirrorlist
+}
+
+func (r *Route) matches(repo *database.Repository) bool {
+	return (r.Repo == "" || r.Repo == repo.Name) && (r.Arch == "" || r.Arch == repo.Arch)
+}
+
+// sameSource reports whether both routes match the same repositories with
+// mirrors from the same files and servers
+func (r *Route) sameSource(other *Route) bool {
+	return r.Repo == other.Repo && r.Arch == other.Arch &&
+		reflect.DeepEqual(r.Mirrorlists, other.Mirrorlists) && reflect.DeepEqual(r.Servers, other.Servers)
+}
+
+// SetRoutes replaces the routes used for new requests. The first matching
+// route selects the mirrors of a repository, the mirrors set with SetMirrors
+// are used for repositories without one.
+func (c *Cache) SetRoutes(routes []Route) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.routes = routes
+}
+
+// mirrorsFor returns the mirrors carrying the given repository in the order
+// of their mirrorlist
+func (c *Cache) mirrorsFor(repo *database.Repository) mirrorlist.Mirrorlist {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	for i := range c.routes {
+		if c.routes[i].matches(repo) {
+			return c.routes[i].Mirrors
+		}
+	}
+
+	return c.mirrors
+}
+
+// allMirrors returns the mirrors of all routes and the default mirrors
+// without duplicates
+func (c *Cache) allMirrors() mirrorlist.Mirrorlist {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	seen := make(map[mirrorlist.Mirror]struct{})
+	all := make(mirrorlist.Mirrorlist, 0, len(c.mirrors))
+	add := func(mirrors mirrorlist.Mirrorlist) {
+		for _, m := range mirrors {
+			if _, ok := seen[m]; !ok {
+				seen[m] = struct{}{}
+				all = append(all, m)
+			}
+		}
+	}
+
+	add(c.mirrors)
+	for _, r := range c.routes {
+		add(r.Mirrors)
+	}
+
+	return all
+}
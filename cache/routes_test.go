@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+func TestRoutes(t *testing.T) {
+	var defaultCalls, routedCalls int32
+	serve := func(calls *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(calls, 1)
+			if !strings.HasSuffix(r.URL.Path, ".pkg.tar.xz") {
+				w.WriteHeader(404)
+				return
+			}
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(_content))
+		}))
+	}
+	defaultServer := serve(&defaultCalls)
+	defer defaultServer.Close()
+	routedServer := serve(&routedCalls)
+	defer routedServer.Close()
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	defaultMirror := mirrorlist.Mirror(defaultServer.URL + "/$repo/os/$arch")
+	routedMirror := mirrorlist.Mirror(routedServer.URL + "/$repo/$arch")
+	armMirror := mirrorlist.Mirror("http://arm/$arch/$repo")
+	c, err := New(dir, mirrorlist.Mirrorlist{defaultMirror})
+	assert.NoError(t, err)
+	c.SetRoutes([]Route{
+		{Repo: "chaotic-aur", Mirrors: mirrorlist.Mirrorlist{routedMirror}},
+		{Arch: "aarch64", Mirrors: mirrorlist.Mirrorlist{armMirror}},
+	})
+
+	// The first matching route is used
+	assert.Equal(t, mirrorlist.Mirrorlist{routedMirror}, c.mirrorsFor(&database.Repository{Name: "chaotic-aur", Arch: "aarch64"}))
+	assert.Equal(t, mirrorlist.Mirrorlist{armMirror}, c.mirrorsFor(&database.Repository{Name: "core", Arch: "aarch64"}))
+	assert.Equal(t, mirrorlist.Mirrorlist{defaultMirror}, c.mirrorsFor(&database.Repository{Name: "core", Arch: "x86_64"}))
+
+	// Packets of routed repositories are only requested from their mirrors
+	repo := database.Repository{Name: "chaotic-aur", Arch: _arch}
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	if err == nil {
+		r.Close()
+	}
+	waitCached(t, c, repo, _filename)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&defaultCalls))
+	assert.True(t, atomic.LoadInt32(&routedCalls) > 0)
+
+	assert.Equal(t, 3, len(c.Mirrors()))
+}
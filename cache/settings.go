@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"github.com/veecue/pacman-smartmirror/database"
+)
+
+// Policy controls how the cache handles a repository
+type Policy struct {
+	// Disabled repositories are neither cached nor proxied
+	Disabled bool
+	// NoPrefetch disables downloading new versions of cached packets after
+	// database updates
+	NoPrefetch bool
+	// Staged keeps serving the previous database after an update until the
+	// new versions of all cached packets are downloaded
+	Staged bool
+}
+
+// SetPolicies sets the policies of repositories by "$repo" or "$arch/$repo".
+// Policies given for an architecture take precedence.
+func (c *Cache) SetPolicies(policies map[string]Policy) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.policies = policies
+}
+
+// Policy returns the policy of the given repository
+func (c *Cache) Policy(repo *database.Repository) Policy {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	if p, ok := c.policies[repo.Arch+"/"+repo.Name]; ok {
+		return p
+	}
+
+	return c.policies[repo.Name]
+}
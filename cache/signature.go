@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// maxSignatureSize is the maximum size of a detached signature that will be accepted
+const maxSignatureSize = 64 * 1024
+
+// bytesReadSeekCloser serves in-memory data as a ReadSeekCloser
+type bytesReadSeekCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadSeekCloser) Close() error {
+	return nil
+}
+
+// fetchSignature downloads the detached signature of the given packet from the
+// first of the given mirrors that has it.
+func (c *Cache) fetchSignature(ctx context.Context, d *download, mirrors mirrorlist.Mirrorlist) ([]byte, error) {
+	missing := 0
+	for _, mirror := range mirrors {
+		req, _ := http.NewRequest("GET", mirror.SignatureURL(&d.P, &d.R), nil)
+		resp, err := c.do(ctx, req, mirror)
+		if err != nil {
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			if resp.StatusCode == 404 {
+				missing++
+			}
+			resp.Body.Close()
+			continue
+		}
+
+		sig, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		return sig, nil
+	}
+
+	return nil, notFoundOr(missing, mirrors, errors.New("Signature could not be downloaded from any mirror"))
+}
+
+// storeSignature writes the signature of a packet next to it in the cache.
+func (c *Cache) storeSignature(d *download, sig []byte) error {
+	filename := filepath.Join(c.directory, d.Path()+".sig")
+	err := ioutil.WriteFile(filename+".part", sig, 0644)
+	if err != nil {
+		os.Remove(filename + ".part")
+		return errors.Wrap(err, "Error writing signature file")
+	}
+
+	return errors.Wrap(os.Rename(filename+".part", filename), "Error moving signature file")
+}
+
+// GetSignature serves the detached signature of a packet from the cache.
+// Missing signatures are fetched from a mirror and stored next to their
+// packet if the packet itself is cached.
+func (c *Cache) GetSignature(ctx context.Context, p *packet.Packet, repo *database.Repository) (ReadSeekCloser, error) {
+	d := &download{P: *p, R: *repo}
+
+	c.mu.Lock()
+	f, err := os.Open(filepath.Join(c.directory, d.Path()+".sig"))
+	c.mu.Unlock()
+	if err == nil {
+		return f, nil
+	}
+
+	sig, err := c.fetchSignature(ctx, d, c.rankedMirrors(repo))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(c.directory, d.Path()+".sig")); os.IsNotExist(err) &&
+		c.packets[*repo].ByFilename(p.Filename()) != nil {
+		if err := c.storeSignature(d, sig); err == nil {
+			c.grow(p, *repo, int64(len(sig)))
+		}
+	}
+
+	return bytesReadSeekCloser{bytes.NewReader(sig)}, nil
+}
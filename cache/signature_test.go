@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/test"
+)
+
+func TestSignature(t *testing.T) {
+	s := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		assert.Equal(t, _filename+".sig", filename)
+		io.WriteString(w, "signature")
+	})
+	defer s.StopServer(t)
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	const signed = "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz"
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, _arch, _repo), 0755))
+	for _, f := range []string{signed, signed + ".sig", _filename} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, _arch, _repo, f), []byte("cached"), 0644))
+	}
+
+	c, err := New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(s.URL)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(18), c.Size())
+
+	repo := &database.Repository{
+		Name: _repo,
+		Arch: _arch,
+	}
+
+	// Cached signatures are served without asking the upstream server
+	p, err := packet.FromFilename(signed)
+	assert.NoError(t, err)
+	r, err := c.GetSignature(context.Background(), p, repo)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "cached", string(b))
+
+	// Missing signatures of cached packets are fetched and stored
+	p, err = packet.FromFilename(_filename)
+	assert.NoError(t, err)
+	r, err = c.GetSignature(context.Background(), p, repo)
+	assert.NoError(t, err)
+	b, err = ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+	assert.Equal(t, "signature", string(b))
+	b, err = ioutil.ReadFile(filepath.Join(dir, _arch, _repo, _filename+".sig"))
+	assert.NoError(t, err)
+	assert.Equal(t, "signature", string(b))
+	assert.Equal(t, int64(27), c.Size())
+
+	// Signatures are evicted together with their packets
+	c.SetLimits(Limits{MaxSize: 1})
+	for _, f := range []string{signed, signed + ".sig", _filename, _filename + ".sig"} {
+		_, err = os.Stat(filepath.Join(dir, _arch, _repo, f))
+		assert.True(t, os.IsNotExist(err), f)
+	}
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// stagedSuffix is appended to the filename of a staged database. A staged
+// database replaces the live one once the new versions of all cached packets
+// of its repository are available.
+const stagedSuffix = ".staged"
+
+// isStaging reports whether a new database of the repository is staged,
+// c.repoMu has to be held
+func (c *Cache) isStaging(repo *database.Repository) bool {
+	return c.staged[*repo] != nil
+}
+
+// stagedIndex returns the index of the staged database of the given
+// repository or nil if none is staged
+func (c *Cache) stagedIndex(repo *database.Repository) *database.Index {
+	c.repoMu.Lock()
+	defer c.repoMu.Unlock()
+
+	return c.staged[*repo]
+}
+
+// loadStaged reads the staged database of the given repository left from a
+// previous run, c.repoMu has to be held
+func (c *Cache) loadStaged(repo database.Repository) {
+	file := c.repoPath(&repo, database.DB) + stagedSuffix
+	if _, err := os.Stat(file); err != nil {
+		return
+	}
+
+	index, err := database.IndexFromFile(file)
+	if err != nil {
+		log.Println("Removing invalid staged database", repo, err)
+		os.Remove(file)
+		os.Remove(file + ".sig")
+		return
+	}
+
+	c.staged[repo] = index
+}
+
+// discardStaged removes the staged database of the given repository,
+// c.repoMu has to be held
+func (c *Cache) discardStaged(repo *database.Repository) {
+	if !c.isStaging(repo) {
+		return
+	}
+
+	file := c.repoPath(repo, database.DB) + stagedSuffix
+	os.Remove(file)
+	os.Remove(file + ".sig")
+	delete(c.staged, *repo)
+}
+
+// promoteStaged makes the staged database of the given repository live if
+// it still has the given index. Old versions of packets kept for the
+// previous database are removed afterwards.
+func (c *Cache) promoteStaged(repo database.Repository, index *database.Index) error {
+	c.repoMu.Lock()
+	if c.staged[repo] != index {
+		// Replaced by a newer staged database in the meantime
+		c.repoMu.Unlock()
+		return nil
+	}
+
+	archived := c.archiveDB(&repo)
+	file := c.repoPath(&repo, database.DB)
+	err := os.Rename(file+stagedSuffix, file)
+	if err != nil {
+		if archived != "" {
+			c.unarchiveDB(&repo, archived)
+		}
+		c.repoMu.Unlock()
+		return errors.Wrap(err, "Error moving staged database")
+	}
+
+	os.Remove(file + ".sig")
+	if err := os.Rename(file+stagedSuffix+".sig", file+".sig"); err != nil && !os.IsNotExist(err) {
+		log.Println(errors.Wrap(err, "Error moving staged signature"))
+	}
+
+	c.indexes[repo] = index
+	delete(c.staged, repo)
+	c.repoMu.Unlock()
+	log.Println("Staged database of", repo, "is now live")
+
+	if !c.Archive().Enabled {
+		c.mu.Lock()
+		c.removeOutdated(repo)
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// removeOutdated removes the packets of the given repository of which a
+// newer version is cached, c.mu has to be held
+func (c *Cache) removeOutdated(repo database.Repository) {
+	outdated := make([]*packet.Packet, 0)
+	for _, p := range c.packets[repo] {
+		for _, other := range c.packets[repo].FindOtherVersions(p) {
+			if packet.CompareVersions(p.Version, other.Version) < 0 {
+				outdated = append(outdated, p)
+				break
+			}
+		}
+	}
+
+	for _, p := range outdated {
+		if err := c.removePacket(p, repo); err != nil {
+			log.Println(errors.Wrap(err, "Error removing old packet"))
+			continue
+		}
+		log.Println("Removed old packet", filepath.Join(repo.Arch, repo.Name, p.Filename()))
+	}
+}
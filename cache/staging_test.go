@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+func TestStaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	const newFilename = "linux-5.3.arch1-1-x86_64.pkg.tar.xz"
+	repo := database.Repository{Name: _repo, Arch: _arch}
+	var db atomic.Value
+	var modTime atomic.Value
+	var available int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + _repo + ".db":
+			http.ServeContent(w, r, r.URL.Path, modTime.Load().(time.Time), bytes.NewReader(db.Load().([]byte)))
+		case "/" + newFilename:
+			if atomic.LoadInt32(&available) == 0 {
+				w.WriteHeader(503)
+				return
+			}
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(_content))
+		case "/" + _filename:
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader(_content))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer mirror.Close()
+
+	published := time.Now().Add(-time.Hour)
+	publish := func(filename string) {
+		writeTestDB(t, dir, repo, _content, filename)
+		b, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo+".db"))
+		assert.NoError(t, err)
+		db.Store(b)
+		published = published.Add(time.Minute)
+		modTime.Store(published)
+	}
+	update := func(c *Cache) {
+		res := make(chan error)
+		assert.NoError(t, c.RefreshRepo(&repo, res))
+		assert.NoError(t, <-res)
+	}
+	liveDB := func(c *Cache) []byte {
+		f, err := c.GetDBFile(&repo, database.DB)
+		assert.NoError(t, err)
+		data, _ := readDBFile(t, f)
+		return data
+	}
+	cached := func(c *Cache, filename string) bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.packets[repo].ByFilename(filename) != nil
+	}
+
+	cacheDir := filepath.Join(dir, "cache")
+	assert.NoError(t, os.Mkdir(cacheDir, 0755))
+	c, err := New(cacheDir, mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL)})
+	assert.NoError(t, err)
+	c.SetPolicies(map[string]Policy{_repo: {Staged: true}})
+
+	// The first database goes live right away
+	publish(_filename)
+	oldDB := db.Load().([]byte)
+	update(c)
+	assert.Equal(t, oldDB, liveDB(c))
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+	assert.NoError(t, c.backgroundDownload(&download{P: *p, R: repo}))
+
+	// A new database is staged while its packets are missing
+	publish(newFilename)
+	update(c)
+	assert.NotNil(t, c.stagedIndex(&repo))
+	assert.Equal(t, oldDB, liveDB(c))
+	assert.NotNil(t, c.Repos()[0].Staged)
+
+	// The staged database is kept over a restart
+	assert.NoError(t, c.Close(context.Background()))
+	c, err = New(cacheDir, mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL)})
+	assert.NoError(t, err)
+	c.SetPolicies(map[string]Policy{_repo: {Staged: true}})
+	assert.NotNil(t, c.stagedIndex(&repo))
+	assert.Equal(t, oldDB, liveDB(c))
+
+	// Once all packets are downloaded, the staged database goes live and
+	// the old packets are removed
+	atomic.StoreInt32(&available, 1)
+	update(c)
+	for i := 0; i < 1000 && c.stagedIndex(&repo) != nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, c.stagedIndex(&repo))
+	assert.Equal(t, db.Load().([]byte), liveDB(c))
+	assert.True(t, cached(c, newFilename))
+	assert.False(t, cached(c, _filename))
+	_, err = os.Stat(c.repoPath(&repo, database.DB) + stagedSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+// errStalled is returned when reading a response body that stalled
+var errStalled = errors.New("Upstream transfer stalled")
+
+// localClient fetches file:// URLs from the local filesystem, mirrors on a
+// mounted path behave just like HTTP mirrors including range requests
+var localClient = &http.Client{Transport: fileTransport{http.NewFileTransport(http.Dir("/"))}}
+
+// fileTransport sets the content length of responses of the file transport
+// which only reports it in the header
+type fileTransport struct {
+	rt http.RoundTripper
+}
+
+func (t fileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil || resp.ContentLength >= 0 {
+		return resp, err
+	}
+
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = n
+	}
+	return resp, nil
+}
+
+// Upstream holds the settings for requests to the mirrors
+type Upstream struct {
+	Client    *http.Client
+	UserAgent string
+	// StallTimeout is the time after which a response body that doesn't
+	// deliver any data is aborted, 0 to disable
+	StallTimeout time.Duration
+}
+
+// DefaultUpstream returns the upstream settings used if none are set
+func DefaultUpstream() Upstream {
+	return Upstream{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout:   30 * time.Second,
+				ResponseHeaderTimeout: time.Minute,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		UserAgent:    "pacman-smartmirror/0.0",
+		StallTimeout: time.Minute,
+	}
+}
+
+// SetUpstream sets the settings used for requests to the mirrors
+func (c *Cache) SetUpstream(u Upstream) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.upstream = u
+}
+
+// getUpstream returns the settings for requests to the mirrors
+func (c *Cache) getUpstream() Upstream {
+	c.settingsMu.RLock()
+	defer c.settingsMu.RUnlock()
+
+	return c.upstream
+}
+
+// do sends the given request to a mirror and records its latency and errors.
+// Requests to file:// mirrors are served from the local filesystem.
+// The request is cancelled with ctx and reading the response body fails if
+// it stalls.
+func (c *Cache) do(ctx context.Context, req *http.Request, mirror mirrorlist.Mirror) (*http.Response, error) {
+	u := c.getUpstream()
+	ctx, cancel := context.WithCancel(ctx)
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", u.UserAgent)
+	client := u.Client
+	if req.URL.Scheme == "file" {
+		client = localClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		cancel()
+		if ctx.Err() == nil {
+			c.mirrorFailed(mirror, err)
+		}
+		return nil, err
+	}
+
+	ttfb := time.Since(start)
+	c.metrics.mirrorLatency.WithLabelValues(string(mirror)).Observe(ttfb.Seconds())
+	if resp.StatusCode >= 500 {
+		c.mirrorFailed(mirror, errors.New(resp.Status))
+	} else {
+		c.health.RecordSuccess(mirror, ttfb)
+	}
+
+	resp.Body = newStallReader(resp.Body, u.StallTimeout, cancel)
+	return resp, nil
+}
+
+// stallReader cancels a request when reading its body doesn't make any
+// progress for a given time
+type stallReader struct {
+	// atomically accessed, has to be at the beginning of the struct
+	// for proper alignment on 32 bit machines
+	stalled int32
+
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func newStallReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	r := &stallReader{
+		body:    body,
+		timeout: timeout,
+		cancel:  cancel,
+	}
+	if timeout > 0 {
+		r.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&r.stalled, 1)
+			cancel()
+		})
+	}
+
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if atomic.LoadInt32(&r.stalled) == 1 {
+		return n, errStalled
+	}
+
+	if n > 0 && r.timer != nil {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// Close closes the body and releases the resources of the request
+func (r *stallReader) Close() error {
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+func TestFileMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	mirrorDir := filepath.Join(dir, "mirror", _repo, "os", _arch)
+	assert.NoError(t, os.MkdirAll(cacheDir, 0755))
+	assert.NoError(t, os.MkdirAll(mirrorDir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(mirrorDir, _filename), []byte(_content), 0644))
+
+	mirrors, err := mirrorlist.FromReader(strings.NewReader("Server = file://" + filepath.Join(dir, "mirror") + "/$repo/os/$arch\n"))
+	assert.NoError(t, err)
+	c, err := New(cacheDir, mirrors)
+	assert.NoError(t, err)
+	repo := database.Repository{Name: _repo, Arch: _arch}
+
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+	r, err := c.GetPacket(context.Background(), p, &repo)
+	assert.NoError(t, err)
+	if err == nil {
+		assert.Equal(t, len(_content), getSize(t, r))
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, _content, string(data))
+		r.Close()
+	}
+	waitCached(t, c, repo, _filename)
+
+	// Missing files are reported like on HTTP mirrors
+	p, err = packet.FromFilename("missing-1.0-1-x86_64.pkg.tar.xz")
+	assert.NoError(t, err)
+	_, err = c.GetPacket(context.Background(), p, &repo)
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(c.Downloads()))
+}
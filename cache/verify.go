@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"log"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/database"
+)
+
+// lookupInfo searches the live and the staged index of the download's
+// repository for the metadata of the downloaded packet. It takes c.repoMu,
+// so c.mu must not be held.
+func (c *Cache) lookupInfo(d *download) (*database.PackageInfo, error) {
+	c.repoMu.Lock()
+	indexes := []*database.Index{c.indexes[d.R], c.staged[d.R]}
+	c.repoMu.Unlock()
+	if indexes[0] == nil {
+		return nil, errors.New("Database not available")
+	}
+
+	for _, index := range indexes {
+		if index == nil {
+			continue
+		}
+		if info := index.ByFilename(d.P.Filename()); info != nil {
+			return info, nil
+		}
+	}
+
+	return nil, errors.New("Packet not found in database")
+}
+
+// verifyDownload checks the downloaded packet with the given size and hex encoded
+// SHA256 sum against the values found in the cached database.
+// Packets that can't be found in the database are not verified.
+func (c *Cache) verifyDownload(d *download, size int64, sha256 string) error {
+	info, err := c.lookupInfo(d)
+	if err != nil {
+		log.Println("Not verifying", d.Path()+":", err)
+		return nil
+	}
+
+	if info.CSize > 0 && info.CSize != size {
+		return errors.Errorf("Size mismatch for %s: got %d bytes, expected %d", d.Path(), size, info.CSize)
+	}
+
+	if info.SHA256Sum != "" && info.SHA256Sum != sha256 {
+		return errors.Errorf("SHA256 mismatch for %s: got %s, expected %s", d.Path(), sha256, info.SHA256Sum)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/test"
+)
+
+// writeTestDB stores a database for the given repository in the cache directory
+// containing the given packet filenames with the checksum of content
+func writeTestDB(t *testing.T, dir string, repo database.Repository, content string, filenames ...string) {
+	sum := sha256.Sum256([]byte(content))
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, filename := range filenames {
+		p, err := packet.FromFilename(filename)
+		assert.NoError(t, err)
+		desc := fmt.Sprintf("%%FILENAME%%\n%s\n\n%%NAME%%\n%s\n\n%%VERSION%%\n%s\n\n%%CSIZE%%\n%d\n\n%%SHA256SUM%%\n%s\n",
+			filename, p.Name, p.Version, len(content), hex.EncodeToString(sum[:]))
+		assert.NoError(t, tw.WriteHeader(&tar.Header{
+			Name: p.Name + "-" + p.Version + "/desc",
+			Mode: 0644,
+			Size: int64(len(desc)),
+		}))
+		_, err = io.WriteString(tw, desc)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, tw.Close())
+	assert.NoError(t, zw.Close())
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, repo.Arch), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, repo.Arch, repo.Name+".db"), buf.Bytes(), 0644))
+}
+
+func TestVerify(t *testing.T) {
+	var badCalls, goodCalls int32
+	bad := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			w.WriteHeader(404)
+			return
+		}
+		atomic.AddInt32(&badCalls, 1)
+		http.ServeContent(w, &http.Request{}, filename, time.Time{}, strings.NewReader(strings.ToUpper(_content)))
+	})
+	defer bad.StopServer(t)
+	good := test.NewServer(t, func(w http.ResponseWriter, filename string, repo string, arch string) {
+		if strings.HasSuffix(filename, ".sig") {
+			io.WriteString(w, "signature")
+			return
+		}
+		atomic.AddInt32(&goodCalls, 1)
+		http.ServeContent(w, &http.Request{}, filename, time.Time{}, strings.NewReader(_content))
+	})
+	defer good.StopServer(t)
+
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(dir))
+	}()
+
+	repo := database.Repository{
+		Name: _repo,
+		Arch: _arch,
+	}
+	writeTestDB(t, dir, repo, _content, _filename)
+
+	c, err := New(dir, mirrorlist.Mirrorlist{mirrorlist.Mirror(bad.URL), mirrorlist.Mirror(good.URL)})
+	assert.NoError(t, err)
+
+	p, err := packet.FromFilename(_filename)
+	assert.NoError(t, err)
+
+	// A client attached to the corrupt download must not receive all data
+	d := &download{P: *p, R: repo}
+	info, _ := c.lookupInfo(d)
+	c.mu.Lock()
+	dl, err := c.startDownload(d, info)
+	c.mu.Unlock()
+	assert.NoError(t, err)
+	r, err := dl.GetReader(context.Background())
+	assert.NoError(t, err)
+	for atomic.LoadInt32(&dl.state) == downloadRunning {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = ioutil.ReadAll(r)
+	assert.Error(t, err)
+	assert.NoError(t, r.Close())
+
+	// The download is retried from the next mirror
+	for {
+		c.mu.Lock()
+		cached := c.packets[repo].ByFilename(_filename)
+		c.mu.Unlock()
+		if cached != nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, _arch, _repo, _filename))
+	assert.NoError(t, err)
+	assert.Equal(t, _content, string(b))
+	b, err = ioutil.ReadFile(filepath.Join(dir, _arch, _repo, _filename+".sig"))
+	assert.NoError(t, err)
+	assert.Equal(t, "signature", string(b))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&badCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&goodCalls))
+}
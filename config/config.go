@@ -1,17 +1,349 @@
 package config
 
-import "flag"
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
-// C represents the applications current config
-var C struct {
-	CacheDirectory string
-	MirrorlistFile string
-	Listen         string
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/pgp"
+	"github.com/veecue/pacman-smartmirror/scheduler"
+)
+
+// EnvPrefix is the prefix of all environment variables overriding options
+const EnvPrefix = "SMARTMIRROR_"
+
+// Config is the configuration of the application
+type Config struct {
+	// Listen holds the addresses the HTTP server listens on
+	Listen []string `toml:"listen"`
+	// BasePath is the path prefix all requests are served under, e.g. when
+	// running behind a reverse proxy
+	BasePath       string `toml:"base_path"`
+	CacheDirectory string `toml:"cache_directory"`
+	// Mirrorlists holds the mirrorlist files to use, their servers are
+	// combined in the given order
+	Mirrorlists []string `toml:"mirrorlists"`
+	// MirrorlistPollInterval is the time between two checks of the
+	// mirrorlists for changes, 0 to disable
+	MirrorlistPollInterval Duration `toml:"mirrorlist_poll_interval"`
+	// UpdateInterval is the time between two database updates
+	UpdateInterval Duration `toml:"update_interval"`
+	// UpdateJitter is the maximum random delay added to each database update
+	UpdateJitter Duration `toml:"update_jitter"`
+	// UpdateWindows restrict the database updates to times of day like
+	// "01:00-05:00"
+	UpdateWindows []string `toml:"update_windows"`
+	MaxCacheSize  Size     `toml:"max_cache_size"`
+	MinFreeSpace  Size     `toml:"min_free_space"`
+	Upstream      Upstream `toml:"upstream"`
+	// ShutdownTimeout is the time given to client transfers and downloads to
+	// finish when shutting down
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+	// Repos holds the policies of repositories by "$repo" or "$arch/$repo"
+	Repos map[string]RepoPolicy `toml:"repos"`
+	// Routes select the mirrors of repositories, the first matching route is
+	// used and the mirrorlists for repositories without one
+	Routes []Route `toml:"routes"`
+	// Keyring is the file holding the trusted OpenPGP keys, downloads failing
+	// the verification are quarantined. Nothing is verified if empty.
+	Keyring string `toml:"keyring"`
+	// Archive keeps the past states of the repositories
+	Archive Archive `toml:"archive"`
+	// API configures the admin API
+	API API `toml:"api"`
+
+	// errors found while loading, reported by Validate
+	loadErrors Errors
+}
+
+// Upstream holds the settings for requests to the mirrors
+type Upstream struct {
+	UserAgent string `toml:"user_agent"`
+	// Proxy is the URL of the proxy to use, the HTTP_PROXY environment
+	// variables are used if empty
+	Proxy          string   `toml:"proxy"`
+	ConnectTimeout Duration `toml:"connect_timeout"`
+	// ResponseTimeout is the time to wait for the response headers
+	ResponseTimeout Duration `toml:"response_timeout"`
+	// StallTimeout is the time after which transfers without progress are
+	// aborted, 0 to disable
+	StallTimeout      Duration `toml:"stall_timeout"`
+	MaxConnsPerMirror int      `toml:"max_conns_per_mirror"`
+}
+
+// API holds the settings of the admin API
+type API struct {
+	Enabled bool `toml:"enabled"`
+	// Listen holds the addresses the API listens on. They have to differ
+	// from the addresses of the mirror so its clients can't use the API.
+	Listen []string `toml:"listen"`
+}
+
+// Archive holds the settings of the point-in-time archive
+type Archive struct {
+	// Enabled keeps the previous databases and all versions of the cached
+	// packets to serve them under /archive/YYYY/MM/DD/
+	Enabled bool `toml:"enabled"`
+	// Retention is the time previous databases are kept after they were
+	// replaced, 0 keeps them forever
+	Retention Duration `toml:"retention"`
+}
+
+// RepoPolicy controls how a repository is handled
+type RepoPolicy struct {
+	// Disabled repositories are neither cached nor proxied
+	Disabled bool `toml:"disabled"`
+	// NoPrefetch disables downloading new versions of cached packets
+	// after database updates
+	NoPrefetch bool `toml:"no_prefetch"`
+	// Staged keeps serving the previous database after an update until the
+	// new versions of all cached packets are downloaded
+	Staged bool `toml:"staged"`
+}
+
+// Route selects the mirrors of the repositories matching Repo and Arch,
+// empty values match any repository or architecture
+type Route struct {
+	Repo string `toml:"repo"`
+	Arch string `toml:"arch"`
+	// Mirrorlists and Servers are combined with the servers of the
+	// mirrorlists first
+	Mirrorlists []string `toml:"mirrorlists"`
+	Servers     []string `toml:"servers"`
+}
+
+// Default returns the configuration used for options that aren't set
+func Default() *Config {
+	return &Config{
+		Listen:                 []string{":41234"},
+		UpdateInterval:         Duration(20 * time.Minute),
+		MirrorlistPollInterval: Duration(time.Minute),
+		ShutdownTimeout:        Duration(30 * time.Second),
+		API: API{
+			Enabled: true,
+			Listen:  []string{"localhost:41235"},
+		},
+		Upstream: Upstream{
+			UserAgent:       "pacman-smartmirror/0.0",
+			ConnectTimeout:  Duration(30 * time.Second),
+			ResponseTimeout: Duration(time.Minute),
+			StallTimeout:    Duration(time.Minute),
+		},
+	}
+}
+
+// Load reads the configuration from the given TOML file and applies
+// overrides from the environment. Options missing from the file keep their
+// default value, no file is read if filename is empty.
+//
+// Only errors preventing the file from being read are returned, all other
+// problems are reported by Validate.
+func Load(filename string) (*Config, error) {
+	c := Default()
+	if filename != "" {
+		md, err := toml.DecodeFile(filename, c)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading config file %s", filename)
+		}
+
+		for _, key := range md.Undecoded() {
+			c.loadErrors = append(c.loadErrors, errors.Errorf("Unknown option %s", key))
+		}
+	}
+
+	c.loadErrors = append(c.loadErrors, applyEnv(c, EnvPrefix, os.LookupEnv)...)
+	return c, nil
+}
+
+// Validate checks the configuration and returns all problems found as
+// Errors, nil if the configuration is valid
+func (c *Config) Validate() error {
+	errs := append(Errors{}, c.loadErrors...)
+
+	if len(c.Listen) == 0 {
+		errs = append(errs, errors.New("No listen address given"))
+	}
+
+	if c.API.Enabled {
+		if len(c.API.Listen) == 0 {
+			errs = append(errs, errors.New("No listen address given for the API"))
+		}
+		for _, addr := range c.API.Listen {
+			for _, mirrorAddr := range c.Listen {
+				if addr == mirrorAddr {
+					errs = append(errs, errors.Errorf("The API can't listen on %s, it is used by the mirror", addr))
+				}
+			}
+		}
+	}
+
+	if strings.ContainsAny(c.BasePath, "?#") {
+		errs = append(errs, errors.Errorf(`Invalid base path "%s"`, c.BasePath))
+	}
+
+	if c.CacheDirectory == "" {
+		errs = append(errs, errors.New("No cache directory given"))
+	} else if stat, err := os.Stat(c.CacheDirectory); err != nil {
+		errs = append(errs, errors.Wrap(err, "Invalid cache directory"))
+	} else if !stat.IsDir() {
+		errs = append(errs, errors.Errorf("Cache directory %s is not a directory", c.CacheDirectory))
+	}
+
+	if len(c.Mirrorlists) == 0 {
+		errs = append(errs, errors.New("No mirrorlist given"))
+	}
+	for _, filename := range c.Mirrorlists {
+		m, err := mirrorlist.FromFile(filename)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "Invalid mirrorlist %s", filename))
+		} else if len(m) == 0 {
+			errs = append(errs, errors.Errorf("Mirrorlist %s contains no servers", filename))
+		}
+	}
+
+	if c.MirrorlistPollInterval < 0 {
+		errs = append(errs, errors.New("mirrorlist_poll_interval can't be negative"))
+	}
+
+	if c.UpdateInterval <= 0 {
+		errs = append(errs, errors.New("update_interval has to be positive"))
+	}
+	if c.UpdateJitter < 0 {
+		errs = append(errs, errors.New("update_jitter can't be negative"))
+	}
+	for _, w := range c.UpdateWindows {
+		if _, err := scheduler.ParseWindow(w); err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid update window"))
+		}
+	}
+
+	if c.Upstream.Proxy != "" {
+		if u, err := url.Parse(c.Upstream.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, errors.Errorf(`Invalid upstream proxy "%s"`, c.Upstream.Proxy))
+		}
+	}
+	if c.Upstream.ConnectTimeout < 0 || c.Upstream.ResponseTimeout < 0 || c.Upstream.StallTimeout < 0 {
+		errs = append(errs, errors.New("Upstream timeouts can't be negative"))
+	}
+	if c.Upstream.MaxConnsPerMirror < 0 {
+		errs = append(errs, errors.New("max_conns_per_mirror can't be negative"))
+	}
+
+	if c.Archive.Retention < 0 {
+		errs = append(errs, errors.New("Archive retention can't be negative"))
+	}
+
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown_timeout can't be negative"))
+	}
+
+	for key := range c.Repos {
+		parts := strings.Split(key, "/")
+		if len(parts) > 2 || parts[0] == "" || parts[len(parts)-1] == "" {
+			errs = append(errs, errors.Errorf(`Invalid repository "%s", has to be "$repo" or "$arch/$repo"`, key))
+		}
+	}
+
+	for i, r := range c.Routes {
+		if m, err := r.Mirrors(); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Invalid route %d", i+1))
+		} else if len(m) == 0 {
+			errs = append(errs, errors.Errorf("Route %d has no servers", i+1))
+		}
+	}
+
+	if _, err := c.LoadKeyring(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// LoadKeyring reads the configured keyring, nil if none is configured
+func (c *Config) LoadKeyring() (*pgp.Keyring, error) {
+	if c.Keyring == "" {
+		return nil, nil
+	}
+
+	k, err := pgp.LoadKeyring(c.Keyring)
+	return k, errors.Wrap(err, "Invalid keyring")
 }
 
-func init() {
-	flag.StringVar(&C.CacheDirectory, "d", "", "Directory to use for the cached packages")
-	flag.StringVar(&C.MirrorlistFile, "m", "", "Filename of the mirrorlist to use")
-	flag.StringVar(&C.Listen, "l", ":41234", "Address and port for the HTTP server to listen on")
-	flag.Parse()
+// UpdateSchedule returns the schedule of the database updates, invalid
+// windows are ignored
+func (c *Config) UpdateSchedule() scheduler.Options {
+	opts := scheduler.Options{
+		Interval: time.Duration(c.UpdateInterval),
+		Jitter:   time.Duration(c.UpdateJitter),
+	}
+	for _, w := range c.UpdateWindows {
+		if window, err := scheduler.ParseWindow(w); err == nil {
+			opts.Windows = append(opts.Windows, window)
+		}
+	}
+
+	return opts
+}
+
+// Client creates the HTTP client to use for requests to the mirrors
+func (u *Upstream) Client() *http.Client {
+	proxy := http.ProxyFromEnvironment
+	if u.Proxy != "" {
+		if proxyURL, err := url.Parse(u.Proxy); err == nil {
+			proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: (&net.Dialer{
+				Timeout:   time.Duration(u.ConnectTimeout),
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   time.Duration(u.ConnectTimeout),
+			ResponseHeaderTimeout: time.Duration(u.ResponseTimeout),
+			MaxConnsPerHost:       u.MaxConnsPerMirror,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// Mirrors reads the mirrorlists of the route and returns them combined with
+// its servers
+func (r *Route) Mirrors() (mirrorlist.Mirrorlist, error) {
+	m, err := mirrorlist.FromFiles(r.Mirrorlists...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range r.Servers {
+		if u, err := url.Parse(server); err != nil || u.Scheme == "" {
+			return nil, errors.Errorf(`"%s" is not a valid server URL`, server)
+		}
+		m = append(m, mirrorlist.Mirror(server))
+	}
+
+	return m, nil
+}
+
+// Errors is a list of errors reported at once
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
 }
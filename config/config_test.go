@@ -0,0 +1,162 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/scheduler"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+	return filename
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mirrors := writeFile(t, dir, "mirrorlist", "Server = http://mirror/$repo/os/$arch\n")
+	filename := writeFile(t, dir, "config.toml", `
+listen = [":80", ":8080"]
+base_path = "/arch"
+cache_directory = "`+dir+`"
+mirrorlists = ["`+mirrors+`"]
+update_interval = "1h"
+update_jitter = "5m"
+update_windows = ["01:00-05:00", "22:00-23:00"]
+max_cache_size = "20G"
+
+[upstream]
+user_agent = "test"
+response_timeout = "10s"
+
+[archive]
+enabled = true
+retention = "720h"
+
+[api]
+listen = ["127.0.0.1:9000"]
+
+[repos.testing]
+disabled = true
+
+[repos."x86_64/core"]
+no_prefetch = true
+staged = true
+
+[[routes]]
+repo = "chaotic-aur"
+servers = ["https://cdn-mirror.chaotic.cx/$repo/$arch"]
+
+[[routes]]
+arch = "aarch64"
+mirrorlists = ["`+mirrors+`"]
+servers = ["http://mirror.archlinuxarm.org/$arch/$repo"]
+`)
+
+	c, err := Load(filename)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, []string{":80", ":8080"}, c.Listen)
+	assert.Equal(t, "/arch", c.BasePath)
+	assert.Equal(t, dir, c.CacheDirectory)
+	assert.Equal(t, Duration(time.Hour), c.UpdateInterval)
+	assert.Equal(t, scheduler.Options{
+		Interval: time.Hour,
+		Jitter:   5 * time.Minute,
+		Windows:  []scheduler.Window{{Start: 60, End: 300}, {Start: 22 * 60, End: 23 * 60}},
+	}, c.UpdateSchedule())
+	assert.Equal(t, Size(20<<30), c.MaxCacheSize)
+	assert.Equal(t, Size(0), c.MinFreeSpace)
+	assert.Equal(t, "test", c.Upstream.UserAgent)
+	assert.Equal(t, Duration(10*time.Second), c.Upstream.ResponseTimeout)
+	// Defaults are kept for missing options
+	assert.Equal(t, Duration(30*time.Second), c.Upstream.ConnectTimeout)
+	assert.Equal(t, Archive{Enabled: true, Retention: Duration(30 * 24 * time.Hour)}, c.Archive)
+	assert.Equal(t, API{Enabled: true, Listen: []string{"127.0.0.1:9000"}}, c.API)
+	assert.Equal(t, RepoPolicy{Disabled: true}, c.Repos["testing"])
+	assert.Equal(t, RepoPolicy{NoPrefetch: true, Staged: true}, c.Repos["x86_64/core"])
+	assert.Equal(t, 2, len(c.Routes))
+	assert.Equal(t, "chaotic-aur", c.Routes[0].Repo)
+	m, err := c.Routes[1].Mirrors()
+	assert.NoError(t, err)
+	assert.Equal(t, mirrorlist.Mirrorlist{"http://mirror/$repo/os/$arch", "http://mirror.archlinuxarm.org/$arch/$repo"}, m)
+
+	_, err = Load(writeFile(t, dir, "broken.toml", "listen = ["))
+	assert.Error(t, err)
+}
+
+func TestEnv(t *testing.T) {
+	c := Default()
+	env := map[string]string{
+		"SMARTMIRROR_LISTEN":                   ":80, :8080",
+		"SMARTMIRROR_CACHE_DIRECTORY":          "/var/cache/pkg",
+		"SMARTMIRROR_MIN_FREE_SPACE":           "2G",
+		"SMARTMIRROR_UPSTREAM_USER_AGENT":      "test",
+		"SMARTMIRROR_UPSTREAM_CONNECT_TIMEOUT": "5s",
+		"SMARTMIRROR_UPDATE_INTERVAL":          "soon",
+		"SMARTMIRROR_REPOS":                    "core",
+		"SMARTMIRROR_API_ENABLED":              "false",
+	}
+	errs := applyEnv(c, EnvPrefix, func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+
+	assert.Equal(t, []string{":80", ":8080"}, c.Listen)
+	assert.Equal(t, "/var/cache/pkg", c.CacheDirectory)
+	assert.Equal(t, Size(2<<30), c.MinFreeSpace)
+	assert.Equal(t, "test", c.Upstream.UserAgent)
+	assert.Equal(t, Duration(5*time.Second), c.Upstream.ConnectTimeout)
+	assert.Equal(t, Duration(20*time.Minute), c.UpdateInterval)
+	assert.False(t, c.API.Enabled)
+	assert.Equal(t, 2, len(errs))
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := writeFile(t, dir, "config.toml", `
+listen = []
+cache_directory = "`+filepath.Join(dir, "missing")+`"
+mirrorlists = ["`+writeFile(t, dir, "mirrorlist", "# empty\n")+`"]
+update_interval = "0s"
+update_windows = ["01:00-05:00", "late"]
+unknown = 1
+keyring = "`+writeFile(t, dir, "keyring", "no keys\n")+`"
+
+[upstream]
+proxy = "not a url"
+
+[archive]
+retention = "-1h"
+
+[api]
+listen = []
+
+[repos."a/b/c"]
+
+[[routes]]
+repo = "nowhere"
+`)
+
+	c, err := Load(filename)
+	assert.NoError(t, err)
+
+	// All errors are reported at once
+	err = c.Validate()
+	assert.Error(t, err)
+	errs, ok := err.(Errors)
+	assert.True(t, ok)
+	assert.Equal(t, 12, len(errs), err.Error())
+}
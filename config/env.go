@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// applyEnv overrides the options of v with environment variables named like
+// the path of the option in upper case, e.g. SMARTMIRROR_UPSTREAM_USER_AGENT.
+// Lists are given comma separated, maps and lists of tables can't be
+// overridden.
+func applyEnv(v interface{}, prefix string, lookup func(string) (string, bool)) Errors {
+	var errs Errors
+	val := reflect.ValueOf(v).Elem()
+	for i := 0; i < val.NumField(); i++ {
+		field := val.Type().Field(i)
+		tag := field.Tag.Get("toml")
+		if tag == "" {
+			continue
+		}
+		name := prefix + strings.ToUpper(tag)
+		fieldVal := val.Field(i)
+
+		_, isText := fieldVal.Addr().Interface().(encoding.TextUnmarshaler)
+		if fieldVal.Kind() == reflect.Struct && !isText {
+			errs = append(errs, applyEnv(fieldVal.Addr().Interface(), name+"_", lookup)...)
+			continue
+		}
+
+		str, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		err := setValue(fieldVal, str)
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "Invalid value for %s", name))
+		}
+	}
+
+	return errs
+}
+
+// setValue parses str into v
+func setValue(v reflect.Value, str string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(str))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(str)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(str)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return errors.New("Unsupported list type")
+		}
+		list := make([]string, 0)
+		for _, s := range strings.Split(str, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("Option can't be set from the environment")
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Size is a number of bytes that can be given with a binary unit suffix
+// (K, M, G or T) like "20G"
+type Size int64
+
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// ParseSize parses a size with an optional unit suffix
+func ParseSize(s string) (Size, error) {
+	str := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	str = strings.TrimSuffix(str, "I")
+
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(str, unit.suffix) {
+			factor = unit.factor
+			str = strings.TrimSuffix(str, unit.suffix)
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, errors.Errorf(`"%s" is not a valid size`, s)
+	}
+
+	// Sizes beyond int64 can't be represented
+	bytes := n * float64(factor)
+	if bytes >= math.MaxInt64 {
+		return 0, errors.Errorf(`Size "%s" is too large`, s)
+	}
+
+	return Size(bytes), nil
+}
+
+// String implements flag.Value
+func (s *Size) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+// Set implements flag.Value
+func (s *Size) Set(str string) error {
+	size, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+
+	*s = size
+	return nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *Size) UnmarshalText(text []byte) error {
+	return s.Set(string(text))
+}
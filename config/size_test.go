@@ -0,0 +1,30 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	for str, size := range map[string]Size{
+		"0":      0,
+		"1234":   1234,
+		"1K":     1024,
+		"20G":    20 << 30,
+		"20GiB":  20 << 30,
+		"1.5m":   3 << 19,
+		" 2T ":   2 << 40,
+		"100B":   100,
+		"0.5KiB": 512,
+	} {
+		s, err := ParseSize(str)
+		assert.NoError(t, err, str)
+		assert.Equal(t, size, s, str)
+	}
+
+	for _, str := range []string{"", "G", "-1G", "20X", "NaN", "inf", "+Inf", "1e400", "1e19", "8388608T"} {
+		_, err := ParseSize(str)
+		assert.Error(t, err, str)
+	}
+}
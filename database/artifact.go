@@ -0,0 +1,41 @@
+package database
+
+import (
+	"strings"
+)
+
+// Artifact is a kind of database file published for a repository
+type Artifact string
+
+const (
+	// DB is the database with the metadata of the packets used by pacman -S
+	DB Artifact = "db"
+	// Files is the database with the file lists of the packets used by pacman -F
+	Files Artifact = "files"
+)
+
+// Artifacts holds all kinds of database files, the database comes first
+var Artifacts = []Artifact{DB, Files}
+
+// Filename returns the name of the artifact file of the given repository
+func (a Artifact) Filename(repo *Repository) string {
+	return repo.Name + "." + string(a)
+}
+
+// ParseArtifact parses a filename like "$repo.db" into the name of the
+// repository and the artifact. Returns false if the file is no artifact.
+func ParseArtifact(filename string) (string, Artifact, bool) {
+	i := strings.LastIndex(filename, ".")
+	if i <= 0 {
+		return "", "", false
+	}
+
+	name, artifact := filename[:i], Artifact(filename[i+1:])
+	for _, a := range Artifacts {
+		if a == artifact {
+			return name, artifact, true
+		}
+	}
+
+	return "", "", false
+}
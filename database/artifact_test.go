@@ -0,0 +1,22 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifact(t *testing.T) {
+	repo := &Repository{Name: "core-testing", Arch: "x86_64"}
+	for _, a := range Artifacts {
+		name, artifact, ok := ParseArtifact(a.Filename(repo))
+		assert.True(t, ok)
+		assert.Equal(t, repo.Name, name)
+		assert.Equal(t, a, artifact)
+	}
+
+	for _, filename := range []string{".db", "core", "core.db.tar.gz", "core.db.sig", "linux-5.2-1-x86_64.pkg.tar.xz"} {
+		_, _, ok := ParseArtifact(filename)
+		assert.False(t, ok, filename)
+	}
+}
@@ -0,0 +1,206 @@
+package database
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// PackageInfo holds the metadata of a packet as found in the "desc" file
+// of its entry in a repository database
+type PackageInfo struct {
+	Filename     string
+	Name         string
+	Base         string
+	Version      string
+	Desc         string
+	Groups       []string
+	CSize        int64
+	ISize        int64
+	MD5Sum       string
+	SHA256Sum    string
+	PGPSig       string
+	URL          string
+	License      []string
+	Arch         string
+	BuildDate    time.Time
+	Packager     string
+	Replaces     []string
+	Conflicts    []string
+	Provides     []string
+	Depends      []string
+	OptDepends   []string
+	MakeDepends  []string
+	CheckDepends []string
+}
+
+// InfoCallback is a callback for the fully parsed metadata of the packets in a database
+type InfoCallback func(*PackageInfo)
+
+// Packet returns the packet described by the info
+func (i *PackageInfo) Packet() (*packet.Packet, error) {
+	return packet.FromFilename(i.Filename)
+}
+
+// ParseDesc parses the content of a "desc" file of a database entry
+func ParseDesc(r io.Reader) (*PackageInfo, error) {
+	info := &PackageInfo{}
+	var key string
+	var values []string
+
+	flush := func() error {
+		if key == "" {
+			return nil
+		}
+
+		single := func() string {
+			if len(values) == 0 {
+				return ""
+			}
+			return values[0]
+		}
+		number := func() (int64, error) {
+			n, err := strconv.ParseInt(single(), 10, 64)
+			return n, errors.Wrapf(err, "Invalid value for %%%s%%", key)
+		}
+
+		var err error
+		switch key {
+		case "FILENAME":
+			info.Filename = single()
+		case "NAME":
+			info.Name = single()
+		case "BASE":
+			info.Base = single()
+		case "VERSION":
+			info.Version = single()
+		case "DESC":
+			info.Desc = single()
+		case "GROUPS":
+			info.Groups = values
+		case "CSIZE":
+			info.CSize, err = number()
+		case "ISIZE":
+			info.ISize, err = number()
+		case "MD5SUM":
+			info.MD5Sum = single()
+		case "SHA256SUM":
+			info.SHA256Sum = single()
+		case "PGPSIG":
+			info.PGPSig = single()
+		case "URL":
+			info.URL = single()
+		case "LICENSE":
+			info.License = values
+		case "ARCH":
+			info.Arch = single()
+		case "BUILDDATE":
+			var date int64
+			date, err = number()
+			info.BuildDate = time.Unix(date, 0)
+		case "PACKAGER":
+			info.Packager = single()
+		case "REPLACES":
+			info.Replaces = values
+		case "CONFLICTS":
+			info.Conflicts = values
+		case "PROVIDES":
+			info.Provides = values
+		case "DEPENDS":
+			info.Depends = values
+		case "OPTDEPENDS":
+			info.OptDepends = values
+		case "MAKEDEPENDS":
+			info.MakeDepends = values
+		case "CHECKDEPENDS":
+			info.CheckDepends = values
+		}
+
+		key = ""
+		values = nil
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
+	// PGP signatures are longer than the default limit of the scanner
+	scanner.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if key == "" {
+			if len(line) < 3 || !strings.HasPrefix(line, "%") || !strings.HasSuffix(line, "%") {
+				return nil, errors.New("Invalid designator: " + line)
+			}
+			key = strings.Trim(line, "%")
+			continue
+		}
+
+		values = append(values, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Error reading desc")
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	if info.Filename == "" {
+		return nil, errors.New("No filename in desc")
+	}
+
+	return info, nil
+}
+
+// ParseDBInfoFromFile reads a pacman .db file and calls cb with the metadata of each packet
+func ParseDBInfoFromFile(filename string, cb InfoCallback) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrap(err, "Error reading file")
+	}
+	defer file.Close()
+
+	return ParseDBInfo(file, cb)
+}
+
+// ParseDBInfo reads a pacman .db file and calls cb with the metadata of each packet
+func ParseDBInfo(r io.Reader, cb InfoCallback) error {
+	zr, err := gzipReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return ParseDBGUnzippedInfo(zr, cb)
+}
+
+// ParseDBGUnzippedInfo reads an uncompressed pacman .db file and calls cb with
+// the metadata of each packet
+func ParseDBGUnzippedInfo(r io.Reader, cb InfoCallback) error {
+	return walkDescs(r, func(desc io.Reader) error {
+		info, err := ParseDesc(desc)
+		if err != nil {
+			return err
+		}
+
+		if _, err = info.Packet(); err != nil {
+			return errors.Wrapf(err, "Invalid filename %s", info.Filename)
+		}
+
+		cb(info)
+		return nil
+	})
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Index is an immutable in-memory index of the packets of a repository database
+// allowing fast lookups without re-reading the database file.
+// All methods can be called on a nil Index which behaves like an empty one.
+type Index struct {
+	byFilename map[string]*PackageInfo
+	byName     map[string]*PackageInfo
+	byProvides map[string][]*PackageInfo
+}
+
+// NewIndex creates an index of the given packets
+func NewIndex(infos []*PackageInfo) *Index {
+	i := &Index{
+		byFilename: make(map[string]*PackageInfo, len(infos)),
+		byName:     make(map[string]*PackageInfo, len(infos)),
+		byProvides: make(map[string][]*PackageInfo),
+	}
+
+	for _, info := range infos {
+		i.byFilename[info.Filename] = info
+		i.byName[info.Name] = info
+		for _, provides := range info.Provides {
+			name := dependencyName(provides)
+			i.byProvides[name] = append(i.byProvides[name], info)
+		}
+	}
+
+	return i
+}
+
+// IndexFromFile creates an index of the given pacman .db file
+func IndexFromFile(filename string) (*Index, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading file")
+	}
+	defer file.Close()
+
+	return ReadIndex(file)
+}
+
+// ReadIndex creates an index of the pacman .db file read from r
+func ReadIndex(r io.Reader) (*Index, error) {
+	infos := make([]*PackageInfo, 0)
+	err := ParseDBInfo(r, func(info *PackageInfo) {
+		infos = append(infos, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewIndex(infos), nil
+}
+
+// dependencyName strips the version constraint from a dependency or provision
+// like "sh=5.0-1"
+func dependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "<>=:"); i >= 0 {
+		return dep[:i]
+	}
+
+	return dep
+}
+
+// Len returns the number of packets in the index
+func (i *Index) Len() int {
+	if i == nil {
+		return 0
+	}
+
+	return len(i.byFilename)
+}
+
+// ByFilename returns the packet with the given filename or nil
+func (i *Index) ByFilename(filename string) *PackageInfo {
+	if i == nil {
+		return nil
+	}
+
+	return i.byFilename[filename]
+}
+
+// ByName returns the packet with the given name or nil
+func (i *Index) ByName(name string) *PackageInfo {
+	if i == nil {
+		return nil
+	}
+
+	return i.byName[name]
+}
+
+// ByProvides returns all packets that satisfy the given dependency: the
+// packet with that name and all packets that provide it. The version
+// constraint of the dependency is ignored.
+func (i *Index) ByProvides(dep string) []*PackageInfo {
+	if i == nil {
+		return nil
+	}
+
+	name := dependencyName(dep)
+	infos := make([]*PackageInfo, 0)
+	if info, ok := i.byName[name]; ok {
+		infos = append(infos, info)
+	}
+
+	for _, info := range i.byProvides[name] {
+		if info.Name != name {
+			infos = append(infos, info)
+		}
+	}
+
+	return infos
+}
+
+// All returns all packets of the index sorted by name
+func (i *Index) All() []*PackageInfo {
+	if i == nil {
+		return nil
+	}
+
+	infos := make([]*PackageInfo, 0, len(i.byFilename))
+	for _, info := range i.byFilename {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(a, b int) bool {
+		return infos[a].Name < infos[b].Name
+	})
+
+	return infos
+}
@@ -0,0 +1,44 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	infos := make([]*PackageInfo, 0)
+	err := ParseDBGUnzippedInfo(bytes.NewReader(createTestTar()), func(info *PackageInfo) {
+		infos = append(infos, info)
+	})
+	assert.NoError(t, err)
+
+	i := NewIndex(infos)
+	assert.Equal(t, 2, i.Len())
+	assert.Equal(t, "acl", i.ByName("acl").Name)
+	assert.Nil(t, i.ByName("xfsacl"))
+	assert.Equal(t, "gcc", i.ByFilename("gcc-9.1.0-2-x86_64.pkg.tar.xz").Name)
+	assert.Nil(t, i.ByFilename("gcc-9.1.0-1-x86_64.pkg.tar.xz"))
+
+	provides := i.ByProvides("xfsacl")
+	assert.Equal(t, 1, len(provides))
+	assert.Equal(t, "acl", provides[0].Name)
+	provides = i.ByProvides("gcc-multilib>=9")
+	assert.Equal(t, 1, len(provides))
+	assert.Equal(t, "gcc", provides[0].Name)
+	assert.Equal(t, 1, len(i.ByProvides("gcc")))
+	assert.Equal(t, 0, len(i.ByProvides("clang")))
+
+	all := i.All()
+	assert.Equal(t, 2, len(all))
+	assert.Equal(t, "acl", all[0].Name)
+	assert.Equal(t, "gcc", all[1].Name)
+
+	var empty *Index
+	assert.Equal(t, 0, empty.Len())
+	assert.Nil(t, empty.ByName("acl"))
+	assert.Nil(t, empty.ByFilename("acl"))
+	assert.Empty(t, empty.ByProvides("acl"))
+	assert.Empty(t, empty.All())
+}
@@ -2,11 +2,14 @@ package database
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/veecue/pacman-smartmirror/packet"
@@ -22,6 +25,21 @@ func (r Repository) String() string {
 	return r.Arch + "/" + r.Name
 }
 
+var nameRegex = regexp.MustCompile(`^[a-zA-Z0-9_+@-][a-zA-Z0-9._+@-]*$`)
+
+// Validate checks that the name and the architecture of the repository can
+// safely be used in paths
+func (r Repository) Validate() error {
+	if !nameRegex.MatchString(r.Name) {
+		return errors.Errorf(`Invalid repository name "%s"`, r.Name)
+	}
+	if !nameRegex.MatchString(r.Arch) {
+		return errors.Errorf(`Invalid architecture "%s"`, r.Arch)
+	}
+
+	return nil
+}
+
 // PacketCallback is a callback for packets that will receive the packet parsed from
 // the filename and a reader containing the rest of the packages "desc" file with
 // further information
@@ -51,9 +69,9 @@ func ParseDBFromFileSlice(filename string) ([]packet.Packet, error) {
 
 // ParseDB reads a pacman .db file and will call cb for each packet
 func ParseDB(r io.Reader, cb PacketCallback) error {
-	zr, err := gzip.NewReader(r)
+	zr, err := gzipReader(r)
 	if err != nil {
-		return errors.Wrap(err, "Error gunzipping file")
+		return err
 	}
 	defer zr.Close()
 
@@ -62,9 +80,9 @@ func ParseDB(r io.Reader, cb PacketCallback) error {
 
 // ParseDBSlice reads a pacman .db file and creates a []packet.Packet
 func ParseDBSlice(r io.Reader) ([]packet.Packet, error) {
-	zr, err := gzip.NewReader(r)
+	zr, err := gzipReader(r)
 	if err != nil {
-		return nil, errors.Wrap(err, "Error gunzipping file")
+		return nil, err
 	}
 	defer zr.Close()
 
@@ -84,7 +102,32 @@ func ParseDBGUnzippedSlice(r io.Reader) ([]packet.Packet, error) {
 
 // ParseDBGUnzipped reads a pacman .db file and will call cb for each packet
 func ParseDBGUnzipped(r io.Reader, cb PacketCallback) error {
+	return walkDescs(r, func(desc io.Reader) error {
+		buf := bufio.NewReader(desc)
+		str, err := buf.ReadString('\n')
+		if err != nil {
+			return (err)
+		}
+		if str != "%FILENAME%\n" {
+			return errors.New("Invalid filename designator: " + str)
+		}
+		filename, err := buf.ReadString('\n')
+		if err != nil {
+			return (err)
+		}
+		p, err := packet.FromFilename(strings.TrimSuffix(filename, "\n"))
+		if err != nil {
+			return (err)
+		}
 
+		cb(p, buf)
+		return nil
+	})
+}
+
+// walkDescs calls cb with the content of each "desc" file in an uncompressed
+// pacman .db file
+func walkDescs(r io.Reader, cb func(io.Reader) error) error {
 	buf := &bytes.Buffer{}
 	reader := tar.NewReader(r)
 	for {
@@ -101,25 +144,20 @@ func ParseDBGUnzipped(r io.Reader, cb PacketCallback) error {
 		if _, name := filepath.Split(pkg.Name); name != "desc" {
 			continue
 		}
-		io.Copy(buf, reader)
-		str, err := buf.ReadString('\n')
-		if err != nil {
-			return (err)
-		}
-		if str != "%FILENAME%\n" {
-			return errors.New("Invalid filename designator: " + str)
-		}
-		filename, err := buf.ReadString('\n')
-		if err != nil {
-			return (err)
-		}
-		p, err := packet.FromFilename(filename)
-		if err != nil {
-			return (err)
-		}
-
-		cb(p, buf)
 
 		buf.Reset()
+		if _, err := io.Copy(buf, reader); err != nil {
+			return errors.Wrap(err, "Error while reading tar")
+		}
+
+		if err := cb(buf); err != nil {
+			return err
+		}
 	}
 }
+
+// gzipReader opens the gzip compressed stream of a database file
+func gzipReader(r io.Reader) (*gzip.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	return zr, errors.Wrap(err, "Error gunzipping file")
+}
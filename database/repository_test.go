@@ -6,6 +6,7 @@ import (
 	"bytes"
 	"io"
 	"log"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -218,3 +219,58 @@ func TestOtherAttributes(t *testing.T) {
 
 	assert.NoError(t, err)
 }
+
+func TestParseDesc(t *testing.T) {
+	info, err := ParseDesc(strings.NewReader(fileGood))
+	assert.NoError(t, err)
+	assert.Equal(t, "acl-2.2.53-1-x86_64.pkg.tar.xz", info.Filename)
+	assert.Equal(t, "acl", info.Name)
+	assert.Equal(t, "acl", info.Base)
+	assert.Equal(t, "2.2.53-1", info.Version)
+	assert.Equal(t, "Access control list utilities, libraries and headers", info.Desc)
+	assert.Equal(t, int64(135020), info.CSize)
+	assert.Equal(t, int64(314368), info.ISize)
+	assert.Equal(t, "aaaea535e603f2b55cb320a42cc70397", info.MD5Sum)
+	assert.Equal(t, "27f4020c77a11992a75b5b99bc1c22797defcea6283b77eb2c311d77b3404443", info.SHA256Sum)
+	assert.True(t, strings.HasPrefix(info.PGPSig, "iQFCBAABCAAsFiEEAv0c"))
+	assert.Equal(t, "http://savannah.nongnu.org/projects/acl", info.URL)
+	assert.Equal(t, []string{"LGPL"}, info.License)
+	assert.Equal(t, "x86_64", info.Arch)
+	assert.Equal(t, int64(1529391128), info.BuildDate.Unix())
+	assert.Equal(t, "Christian Hesse <arch@eworm.de>", info.Packager)
+	assert.Equal(t, []string{"xfsacl"}, info.Replaces)
+	assert.Equal(t, []string{"xfsacl"}, info.Conflicts)
+	assert.Equal(t, []string{"xfsacl"}, info.Provides)
+	assert.Equal(t, []string{"attr"}, info.Depends)
+
+	p, err := info.Packet()
+	assert.NoError(t, err)
+	assert.Equal(t, "acl", p.Name)
+
+	info, err = ParseDesc(strings.NewReader(gccGood))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"base-devel"}, info.Groups)
+	assert.Equal(t, []string{"GPL", "LGPL", "FDL", "custom"}, info.License)
+	assert.Equal(t, []string{"gcc-libs=9.1.0-2", "binutils>=2.28", "libmpc"}, info.Depends)
+	assert.Equal(t, []string{"lib32-gcc-libs: for generating code for 32-bit ABI"}, info.OptDepends)
+	assert.Equal(t, 8, len(info.MakeDepends))
+	assert.Equal(t, []string{"dejagnu", "inetutils"}, info.CheckDepends)
+
+	_, err = ParseDesc(strings.NewReader("%CSIZE%\nabc\n"))
+	assert.Error(t, err)
+	_, err = ParseDesc(strings.NewReader("NAME\nabc\n"))
+	assert.Error(t, err)
+	_, err = ParseDesc(strings.NewReader("%NAME%\nabc\n"))
+	assert.Error(t, err)
+}
+
+func TestParseDBInfo(t *testing.T) {
+	infos := make([]*PackageInfo, 0)
+	err := ParseDBGUnzippedInfo(bytes.NewReader(createTestTar()), func(info *PackageInfo) {
+		infos = append(infos, info)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, "acl", infos[0].Name)
+	assert.Equal(t, int64(35571360), infos[1].CSize)
+}
@@ -1,43 +1,289 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/veecue/pacman-smartmirror/cache"
 	"github.com/veecue/pacman-smartmirror/config"
 	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/scheduler"
 	"github.com/veecue/pacman-smartmirror/server"
 )
 
 func main() {
+	configFile := flag.String("c", "", "Config file to use")
+	validate := flag.Bool("validate", false, "Only validate the configuration and report all errors")
+	cacheDirectory := flag.String("d", "", "Directory to use for the cached packages")
+	mirrorlistFile := flag.String("m", "", "Filename of the mirrorlist to use")
+	listen := flag.String("l", "", "Address and port for the HTTP server to listen on")
+	var maxCacheSize, minFreeSpace config.Size
+	flag.Var(&maxCacheSize, "max-size", "Maximum size of the cached packages, e.g. 20G (0 for unlimited)")
+	flag.Var(&minFreeSpace, "min-free", "Disk space to always keep free, e.g. 2G (0 to disable)")
 	flag.Parse()
-	log.Printf(`Loading mirrorlist file: "%s"`, config.C.MirrorlistFile)
-	m, err := mirrorlist.FromFile(config.C.MirrorlistFile)
+
+	// Flags take precedence over the config file and the environment
+	applyFlags := func(conf *config.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "d":
+				conf.CacheDirectory = *cacheDirectory
+			case "m":
+				conf.Mirrorlists = []string{*mirrorlistFile}
+			case "l":
+				conf.Listen = []string{*listen}
+			case "max-size":
+				conf.MaxCacheSize = maxCacheSize
+			case "min-free":
+				conf.MinFreeSpace = minFreeSpace
+			}
+		})
+	}
+
+	conf, err := config.Load(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	applyFlags(conf)
+
+	err = conf.Validate()
+	if *validate {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	log.Printf(`Loading mirrorlist files: %q`, conf.Mirrorlists)
+	m, err := mirrorlist.FromFiles(conf.Mirrorlists...)
+	if err != nil {
+		log.Fatalf(`Error reading mirrorlists: %v`, err)
+	}
+
+	routes, err := loadRoutes(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keyring, err := conf.LoadKeyring()
 	if err != nil {
-		log.Fatalf(`Error reading mirrorlist "%s": %v`, config.C.MirrorlistFile, err)
+		log.Fatal(err)
+	}
+	if keyring != nil {
+		log.Printf(`Verifying downloads with %d keys from "%s"`, keyring.Len(), conf.Keyring)
 	}
 
-	log.Printf(`Initing package cache in "%s"`, config.C.CacheDirectory)
-	c, err := cache.New(config.C.CacheDirectory, m)
+	log.Printf(`Initing package cache in "%s"`, conf.CacheDirectory)
+	c, err := cache.New(conf.CacheDirectory, m)
 	if err != nil {
-		log.Fatalf(`Error initing cache "%s": %v`, config.C.CacheDirectory, err)
+		log.Fatalf(`Error initing cache "%s": %v`, conf.CacheDirectory, err)
 	}
-	c.UpdateDatabases(nil)
-	go func() {
+	c.SetRoutes(routes)
+	c.SetKeyring(keyring)
+	applySettings(c, conf)
+	c.WatchMirrorlists(conf.Mirrorlists, time.Duration(conf.MirrorlistPollInterval))
+
+	updates := scheduler.New("database update", conf.UpdateSchedule(), func() error {
 		res := make(chan error)
-		for range time.Tick(20 * time.Minute) {
-			c.UpdateDatabases(res)
-			<-res
-		}
-	}()
+		c.UpdateDatabases(res)
+		return <-res
+	})
+	updates.Start()
 
 	s := server.New(c)
-	log.Println("Listening on", config.C.Listen)
-	err = http.ListenAndServe(config.C.Listen, s)
+	s.SetUpdateScheduler(updates)
+	s.SetBasePath(conf.BasePath)
+	servers := make([]*http.Server, 0, len(conf.Listen)+len(conf.API.Listen))
+	for _, addr := range conf.Listen {
+		servers = append(servers, &http.Server{Addr: addr, Handler: s})
+	}
+	if conf.API.Enabled {
+		// The API is kept away from the clients of the mirror
+		for _, addr := range conf.API.Listen {
+			log.Println("Serving the API on", addr)
+			servers = append(servers, &http.Server{Addr: addr, Handler: s.API()})
+		}
+	}
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			log.Println("Listening on", srv.Addr)
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				errs <- errors.Wrapf(err, "Error listening on %s", srv.Addr)
+			}
+		}(srv)
+	}
+
+	// SIGUSR1 triggers a database update, SIGHUP reloads the configuration
+	// and SIGTERM and SIGINT shut down gracefully
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for {
+		select {
+		case err := <-errs:
+			log.Fatal(err)
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGUSR1:
+				if !updates.Trigger() {
+					log.Println("Database update already running")
+				}
+			case syscall.SIGHUP:
+				conf = reload(*configFile, applyFlags, conf, c, updates)
+			default:
+				log.Println("Received", sig, "shutting down")
+				shutdown(time.Duration(conf.ShutdownTimeout), servers, c, updates)
+				return
+			}
+		}
+	}
+}
+
+// applySettings applies the settings of the configuration that can be
+// changed at runtime to the cache
+func applySettings(c *cache.Cache, conf *config.Config) {
+	c.SetLimits(cache.Limits{
+		MaxSize: int64(conf.MaxCacheSize),
+		MinFree: int64(conf.MinFreeSpace),
+	})
+	c.SetUpstream(cache.Upstream{
+		Client:       conf.Upstream.Client(),
+		UserAgent:    conf.Upstream.UserAgent,
+		StallTimeout: time.Duration(conf.Upstream.StallTimeout),
+	})
+	policies := make(map[string]cache.Policy)
+	for repo, p := range conf.Repos {
+		policies[repo] = cache.Policy{
+			Disabled:   p.Disabled,
+			NoPrefetch: p.NoPrefetch,
+			Staged:     p.Staged,
+		}
+	}
+	c.SetPolicies(policies)
+	c.SetArchive(cache.Archive{
+		Enabled:   conf.Archive.Enabled,
+		Retention: time.Duration(conf.Archive.Retention),
+	})
+}
+
+// loadRoutes reads the mirrors of the routes of the configuration
+func loadRoutes(conf *config.Config) ([]cache.Route, error) {
+	routes := make([]cache.Route, len(conf.Routes))
+	for i, r := range conf.Routes {
+		m, err := r.Mirrors()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading the mirrors of route %d", i+1)
+		}
+		servers := make(mirrorlist.Mirrorlist, len(r.Servers))
+		for j, server := range r.Servers {
+			servers[j] = mirrorlist.Mirror(server)
+		}
+		routes[i] = cache.Route{Repo: r.Repo, Arch: r.Arch, Mirrors: m, Mirrorlists: r.Mirrorlists, Servers: servers}
+	}
+
+	return routes, nil
+}
+
+// reload reads the configuration and the mirrorlists again and applies them
+// without interrupting running transfers. Returns the new configuration, the
+// current one is kept if the new one is invalid.
+func reload(filename string, applyFlags func(*config.Config), current *config.Config, c *cache.Cache, updates *scheduler.Scheduler) *config.Config {
+	log.Println("Reloading configuration")
+	conf, err := config.Load(filename)
+	if err != nil {
+		log.Println("Keeping the current configuration:", err)
+		return current
+	}
+	applyFlags(conf)
+	if err := conf.Validate(); err != nil {
+		log.Printf("Keeping the current configuration, the new one is invalid:\n%v", err)
+		return current
+	}
+
+	m, err := mirrorlist.FromFiles(conf.Mirrorlists...)
+	if err != nil {
+		log.Println("Keeping the current configuration:", err)
+		return current
+	}
+	routes, err := loadRoutes(conf)
 	if err != nil {
-		log.Fatalf("Error listening on %s: %v", config.C.Listen, err)
+		log.Println("Keeping the current configuration:", err)
+		return current
+	}
+	keyring, err := conf.LoadKeyring()
+	if err != nil {
+		log.Println("Keeping the current configuration:", err)
+		return current
+	}
+
+	// The listeners, the API, the base path and the cache directory can't be
+	// changed while running
+	if !reflect.DeepEqual(conf.Listen, current.Listen) {
+		log.Println("Changing the listen addresses requires a restart")
+		conf.Listen = current.Listen
+	}
+	if !reflect.DeepEqual(conf.API, current.API) {
+		log.Println("Changing the API settings requires a restart")
+		conf.API = current.API
+	}
+	if conf.BasePath != current.BasePath {
+		log.Println("Changing the base path requires a restart")
+		conf.BasePath = current.BasePath
+	}
+	if conf.CacheDirectory != current.CacheDirectory {
+		log.Println("Changing the cache directory requires a restart")
+		conf.CacheDirectory = current.CacheDirectory
+	}
+
+	c.SetMirrors(m)
+	c.SetRoutes(routes)
+	c.SetKeyring(keyring)
+	c.WatchMirrorlists(conf.Mirrorlists, time.Duration(conf.MirrorlistPollInterval))
+	applySettings(c, conf)
+	updates.SetOptions(conf.UpdateSchedule())
+	log.Printf("Reloaded configuration with %d mirrors", len(m))
+	return conf
+}
+
+// shutdown stops accepting connections and gives client transfers and
+// downloads the timeout to finish. Downloads still running afterwards are
+// interrupted and resumed after the next start.
+func shutdown(timeout time.Duration, servers []*http.Server, c *cache.Cache, updates *scheduler.Scheduler) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down server on %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	// Closing the cache interrupts running database updates, so the
+	// scheduler is stopped afterwards
+	if err := c.Close(ctx); err != nil {
+		log.Println("Error closing cache:", err)
 	}
+	updates.Stop()
+	log.Println("Shut down")
 }
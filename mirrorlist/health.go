@@ -0,0 +1,227 @@
+package mirrorlist
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// FailureThreshold is the number of consecutive failures after which a
+	// mirror is put into cooldown
+	FailureThreshold = 3
+	// BaseCooldown is the cooldown after reaching FailureThreshold. It doubles
+	// with each further failure up to MaxCooldown.
+	BaseCooldown = 30 * time.Second
+	// MaxCooldown is the maximum time a mirror is put into cooldown
+	MaxCooldown = 15 * time.Minute
+
+	// weight of new measurements in the moving averages
+	ewmaWeight = 0.3
+	// size used to combine latency and throughput into a single score
+	scoreSize = 1 << 20
+	// seconds added to the score for each consecutive failure
+	failurePenalty = 10
+)
+
+// MirrorStats holds the recorded health of a mirror
+type MirrorStats struct {
+	Mirror              Mirror `json:"mirror"`
+	Successes           int64  `json:"successes"`
+	Failures            int64  `json:"failures"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	// TTFB is the moving average of the time to the first byte of responses
+	TTFB time.Duration `json:"ttfb_ns"`
+	// Throughput is the moving average of the download speed in bytes per second
+	Throughput    float64   `json:"throughput"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time"`
+	// CooldownUntil is the time until which the mirror is only used if all
+	// other mirrors fail
+	CooldownUntil time.Time `json:"cooldown_until"`
+}
+
+// Score returns the estimated time in seconds it takes to fetch a 1 MiB file
+// from the mirror, increased by a penalty for each consecutive failure
+func (s *MirrorStats) Score() float64 {
+	score := s.TTFB.Seconds()
+	if s.Throughput > 0 {
+		score += scoreSize / s.Throughput
+	}
+
+	return score + float64(s.ConsecutiveFailures)*failurePenalty
+}
+
+// Rank tiers of mirrors, lower tiers are tried first
+const (
+	tierGood = iota
+	tierUnmeasured
+	tierFailing
+	tierCooldown
+)
+
+// tier returns the rank tier of the mirror at the given time
+func (s *MirrorStats) tier(now time.Time) int {
+	switch {
+	case now.Before(s.CooldownUntil):
+		return tierCooldown
+	case s.ConsecutiveFailures > 0:
+		return tierFailing
+	case s.Successes == 0:
+		return tierUnmeasured
+	default:
+		return tierGood
+	}
+}
+
+// Health records the health of mirrors and ranks them accordingly. It is safe
+// for concurrent use.
+type Health struct {
+	stats map[Mirror]*MirrorStats
+	mu    sync.Mutex
+	now   func() time.Time
+}
+
+// NewHealth creates a new health registry without any records
+func NewHealth() *Health {
+	return &Health{
+		stats: make(map[Mirror]*MirrorStats),
+		now:   time.Now,
+	}
+}
+
+// get returns the stats of a mirror, h.mu has to be held
+func (h *Health) get(m Mirror) *MirrorStats {
+	s, ok := h.stats[m]
+	if !ok {
+		s = &MirrorStats{Mirror: m}
+		h.stats[m] = s
+	}
+
+	return s
+}
+
+func ewma(old, new float64) float64 {
+	if old == 0 {
+		return new
+	}
+
+	return old*(1-ewmaWeight) + new*ewmaWeight
+}
+
+// RecordSuccess records a successful response of a mirror received after ttfb
+func (h *Health) RecordSuccess(m Mirror, ttfb time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.get(m)
+	s.Successes++
+	s.ConsecutiveFailures = 0
+	s.CooldownUntil = time.Time{}
+	s.TTFB = time.Duration(ewma(float64(s.TTFB), float64(ttfb)))
+}
+
+// RecordTransfer records a completed transfer of n bytes from a mirror
+func (h *Health) RecordTransfer(m Mirror, n int64, d time.Duration) {
+	if n <= 0 || d <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.get(m)
+	s.Throughput = ewma(s.Throughput, float64(n)/d.Seconds())
+}
+
+// RecordFailure records a failed request or transfer. Mirrors failing
+// repeatedly are put into cooldown.
+func (h *Health) RecordFailure(m Mirror, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.get(m)
+	s.Failures++
+	s.ConsecutiveFailures++
+	s.LastErrorTime = h.now()
+	if err != nil {
+		s.LastError = err.Error()
+	}
+
+	if s.ConsecutiveFailures >= FailureThreshold {
+		cooldown := time.Duration(float64(BaseCooldown) * math.Pow(2, float64(s.ConsecutiveFailures-FailureThreshold)))
+		if cooldown > MaxCooldown || cooldown <= 0 {
+			cooldown = MaxCooldown
+		}
+		s.CooldownUntil = h.now().Add(cooldown)
+	}
+}
+
+// InCooldown reports whether the mirror is currently in cooldown
+func (h *Health) InCooldown(m Mirror) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.stats[m]
+	return ok && h.now().Before(s.CooldownUntil)
+}
+
+// Rank returns the given mirrors ordered by their health: working mirrors
+// ordered by their score come first, followed by mirrors without
+// measurements in the order of the list, failing mirrors and mirrors in
+// cooldown. Mirrors with equal scores keep their order from the list.
+func (h *Health) Rank(list Mirrorlist) Mirrorlist {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	type ranked struct {
+		m     Mirror
+		tier  int
+		score float64
+	}
+	r := make([]ranked, len(list))
+	for i, m := range list {
+		r[i].m = m
+		r[i].tier = tierUnmeasured
+		if s, ok := h.stats[m]; ok {
+			r[i].tier = s.tier(now)
+			r[i].score = s.Score()
+		}
+	}
+
+	sort.SliceStable(r, func(i, j int) bool {
+		if r[i].tier != r[j].tier {
+			return r[i].tier < r[j].tier
+		}
+		if r[i].tier == tierUnmeasured {
+			return false
+		}
+		return r[i].score < r[j].score
+	})
+
+	result := make(Mirrorlist, len(r))
+	for i := range r {
+		result[i] = r[i].m
+	}
+
+	return result
+}
+
+// Stats returns the recorded health of the given mirrors in the given order
+func (h *Health) Stats(list Mirrorlist) []MirrorStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make([]MirrorStats, len(list))
+	for i, m := range list {
+		if s, ok := h.stats[m]; ok {
+			result[i] = *s
+		} else {
+			result[i] = MirrorStats{Mirror: m}
+		}
+	}
+
+	return result
+}
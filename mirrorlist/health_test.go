@@ -0,0 +1,76 @@
+package mirrorlist
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthRank(t *testing.T) {
+	list := Mirrorlist{"http://a/$repo/os/$arch", "http://b/$repo/os/$arch", "http://c/$repo/os/$arch"}
+	h := NewHealth()
+
+	// Without any records the order of the list is kept
+	assert.Equal(t, list, h.Rank(list))
+
+	h.RecordSuccess(list[0], 300*time.Millisecond)
+	h.RecordSuccess(list[1], 50*time.Millisecond)
+	h.RecordSuccess(list[2], 100*time.Millisecond)
+	assert.Equal(t, Mirrorlist{list[1], list[2], list[0]}, h.Rank(list))
+
+	// Mirrors without measurements come after the known good ones in the
+	// order of the list
+	more := append(Mirrorlist{"http://d/$repo/os/$arch", "http://e/$repo/os/$arch"}, list...)
+	assert.Equal(t, Mirrorlist{list[1], list[2], list[0], more[0], more[1]}, h.Rank(more))
+
+	// A slow transfer outweighs a fast first byte
+	h.RecordTransfer(list[1], 1<<20, 2*time.Second)
+	h.RecordTransfer(list[2], 1<<20, 100*time.Millisecond)
+	assert.Equal(t, list[2], h.Rank(list)[0])
+
+	stats := h.Stats(list)
+	assert.Equal(t, int64(1), stats[0].Successes)
+	assert.Equal(t, 300*time.Millisecond, stats[0].TTFB)
+	assert.InDelta(t, float64(1<<19), stats[1].Throughput, 1)
+}
+
+func TestHealthCooldown(t *testing.T) {
+	list := Mirrorlist{"http://a/$repo/os/$arch", "http://b/$repo/os/$arch"}
+	h := NewHealth()
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	// Failures below the threshold rank a mirror lower without a cooldown
+	h.RecordFailure(list[0], errors.New("timeout"))
+	h.RecordSuccess(list[1], time.Second)
+	h.RecordFailure(list[1], errors.New("timeout"))
+	h.RecordFailure(list[0], errors.New("timeout"))
+	assert.False(t, h.InCooldown(list[0]))
+	assert.Equal(t, Mirrorlist{list[1], list[0]}, h.Rank(list))
+
+	h.RecordFailure(list[0], errors.New("connection refused"))
+	assert.True(t, h.InCooldown(list[0]))
+	assert.Equal(t, Mirrorlist{list[1], list[0]}, h.Rank(list))
+
+	stats := h.Stats(list)
+	assert.Equal(t, int64(FailureThreshold), stats[0].Failures)
+	assert.Equal(t, "connection refused", stats[0].LastError)
+	assert.Equal(t, now.Add(BaseCooldown), stats[0].CooldownUntil)
+
+	// The cooldown doubles with every further failure
+	h.RecordFailure(list[0], nil)
+	assert.Equal(t, now.Add(2*BaseCooldown), h.Stats(list)[0].CooldownUntil)
+
+	// The mirror is tried again after the cooldown
+	now = now.Add(2 * BaseCooldown)
+	assert.False(t, h.InCooldown(list[0]))
+	assert.Equal(t, Mirrorlist{list[1], list[0]}, h.Rank(list))
+
+	// A success resets the failures
+	h.RecordSuccess(list[0], time.Millisecond)
+	assert.Equal(t, 0, h.Stats(list)[0].ConsecutiveFailures)
+	h.RecordFailure(list[0], nil)
+	assert.False(t, h.InCooldown(list[0]))
+}
@@ -29,6 +29,21 @@ func FromFile(filename string) (Mirrorlist, error) {
 	return FromReader(file)
 }
 
+// FromFiles reads multiple mirrorlist files and combines their URLs in the
+// given order
+func FromFiles(filenames ...string) (Mirrorlist, error) {
+	m := make(Mirrorlist, 0)
+	for _, filename := range filenames {
+		list, err := FromFile(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Error reading mirrorlist %s", filename)
+		}
+		m = append(m, list...)
+	}
+
+	return m, nil
+}
+
 // FromReader reads a mirrorlist from the given reader and returns the URLs
 func FromReader(r io.Reader) (Mirrorlist, error) {
 	m := make([]Mirror, 0)
@@ -76,10 +91,20 @@ func (m Mirror) PacketURL(p *packet.Packet, repo *database.Repository) string {
 	return r + "/" + p.Filename()
 }
 
+// SignatureURL returns the actual URL of the detached signature of a given packet
+func (m Mirror) SignatureURL(p *packet.Packet, repo *database.Repository) string {
+	return m.PacketURL(p, repo) + ".sig"
+}
+
 // RepoURL returns the actual URL of a given repo db
 func (m Mirror) RepoURL(repo *database.Repository) string {
+	return m.ArtifactURL(repo, database.DB)
+}
+
+// ArtifactURL returns the actual URL of an artifact of a given repo
+func (m Mirror) ArtifactURL(repo *database.Repository, artifact database.Artifact) string {
 	r := strings.ReplaceAll(string(m), "$repo", repo.Name)
 	r = strings.ReplaceAll(r, "$arch", repo.Arch)
 	r = strings.TrimSuffix(r, "/")
-	return r + "/" + repo.Name + ".db"
+	return r + "/" + artifact.Filename(repo)
 }
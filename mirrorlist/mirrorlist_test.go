@@ -40,6 +40,13 @@ func TestMirrorlistGood(t *testing.T) {
 			Arch: "x86_64",
 		})),
 	)
+	assert.Equal(t,
+		"http://mirrors.arnoldthebat.co.uk/archlinux/community/os/x86_64/"+p.Filename()+".sig",
+		m[1].SignatureURL(p, &database.Repository{
+			Name: "community",
+			Arch: "x86_64",
+		}),
+	)
 	assert.Equal(t,
 		"http://mirrors.arnoldthebat.co.uk/archlinux/community/os/x86_64/community.db",
 		m[1].RepoURL(&database.Repository{
@@ -47,6 +54,13 @@ func TestMirrorlistGood(t *testing.T) {
 			Arch: "x86_64",
 		}),
 	)
+	assert.Equal(t,
+		"http://mirrors.arnoldthebat.co.uk/archlinux/community/os/x86_64/community.files",
+		m[1].ArtifactURL(&database.Repository{
+			Name: "community",
+			Arch: "x86_64",
+		}, database.Files),
+	)
 }
 
 type eReader struct{}
@@ -4,28 +4,39 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 )
 
+// Compressions holds the extensions of all compressions makepkg can create
+// packets with
+var Compressions = []string{"gz", "bz2", "xz", "zst", "lz4", "lrz", "lzo", "Z"}
+
 var (
-	filenameRegex = regexp.MustCompile(`(.+)-(.+-.+)-(.+)\.pkg\.tar\.(xz|zst)`)
+	filenameRegex = regexp.MustCompile(`^(.+)-(.+-.+)-(.+)\.pkg\.tar(?:\.(` + strings.Join(Compressions, "|") + `))?$`)
 )
 
 // Packet represents a pacman Packet
 type Packet struct {
-	Name        string
-	Version     string
-	Arch        string
+	Name    string
+	Version string
+	Arch    string
+	// Compression is the extension of the compression of the packet, empty
+	// for uncompressed packets
 	Compression string
 }
 
 // Filename returns the corresponding filename the packet is saved as
 func (p *Packet) Filename() string {
-	return fmt.Sprintf("%s-%s-%s.pkg.tar.%s",
+	filename := fmt.Sprintf("%s-%s-%s.pkg.tar",
 		p.Name,
 		p.Version,
 		p.Arch,
-		p.Compression,
 	)
+	if p.Compression != "" {
+		filename += "." + p.Compression
+	}
+
+	return filename
 }
 
 // FromFilename parses a packet's filename and returns the parsed information
@@ -10,6 +10,7 @@ func TestFilename(t *testing.T) {
 	for _, filename := range []string{
 		"xorg-util-macros-1.19.2-1-any.pkg.tar.xz",
 		"xorg-util-macros-1.21.2-1-any.pkg.tar.zst",
+		"xorg-util-macros-1.21.2-1-any.pkg.tar",
 	} {
 		packet, err := FromFilename(filename)
 		assert.NoError(t, err, "Error while parsing filename: %v", err)
@@ -17,10 +18,34 @@ func TestFilename(t *testing.T) {
 	}
 }
 
+func TestCompressions(t *testing.T) {
+	for _, compression := range append(Compressions, "") {
+		p := &Packet{
+			Name:        "chaotic-keyring",
+			Version:     "1:20230616-1",
+			Arch:        "any",
+			Compression: compression,
+		}
+
+		parsed, err := FromFilename(p.Filename())
+		assert.NoError(t, err, p.Filename())
+		assert.Equal(t, p, parsed)
+	}
+
+	packet, err := FromFilename("linux-5.2.arch2-1-x86_64.pkg.tar")
+	assert.NoError(t, err)
+	assert.Equal(t, "", packet.Compression)
+	assert.Equal(t, "x86_64", packet.Arch)
+}
+
 func TestInvalidFilename(t *testing.T) {
 	for _, filename := range []string{
 		"linux.pkg.tar.xz",
 		"xorg-util-macros-1.21.2-1-any.pkg.tar.foo",
+		"xorg-util-macros-1.21.2-1-any.pkg.tar.zst.sig",
+		"xorg-util-macros-1.21.2-1-any.pkg.tar.z",
+		"xorg-util-macros-1.21.2-1-any.pkg.tar.xz.part",
+		"xorg-util-macros-1.21.2-1-any.tar.gz",
 	} {
 		_, err := FromFilename(filename)
 		assert.Error(t, err)
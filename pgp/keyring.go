@@ -0,0 +1,75 @@
+// Package pgp verifies detached OpenPGP signatures of packets and databases
+package pgp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/pkg/errors"
+)
+
+// Keyring holds the trusted public keys
+type Keyring struct {
+	keys openpgp.EntityList
+}
+
+// LoadKeyring reads a keyring like /usr/share/pacman/keyrings/archlinux.gpg
+func LoadKeyring(filename string) (*Keyring, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading keyring")
+	}
+	defer file.Close()
+
+	return ReadKeyring(file)
+}
+
+// ReadKeyring reads an armored or binary keyring from r
+func ReadKeyring(r io.Reader) (*Keyring, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading keyring")
+	}
+
+	var keys openpgp.EntityList
+	if isArmored(data) {
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing keyring")
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("Keyring contains no keys")
+	}
+
+	return &Keyring{keys}, nil
+}
+
+// Len returns the number of keys in the keyring
+func (k *Keyring) Len() int {
+	return len(k.keys)
+}
+
+// Verify checks that sig is a valid signature of the data read from signed
+// made by one of the keys of the keyring. Both binary and armored signatures
+// are accepted.
+func (k *Keyring) Verify(signed io.Reader, sig []byte) error {
+	var err error
+	if isArmored(sig) {
+		_, err = openpgp.CheckArmoredDetachedSignature(k.keys, signed, bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(k.keys, signed, bytes.NewReader(sig), nil)
+	}
+
+	return errors.Wrap(err, "Invalid signature")
+}
+
+// isArmored reports whether data is ASCII armored
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN"))
+}
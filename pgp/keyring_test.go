@@ -0,0 +1,72 @@
+package pgp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func newKey(t *testing.T, name string, config *packet.Config) (*openpgp.Entity, string) {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", config)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, e.Serialize(w))
+	assert.NoError(t, w.Close())
+	return e, buf.String()
+}
+
+func TestVerify(t *testing.T) {
+	trusted, armored := newKey(t, "trusted", nil)
+	untrusted, _ := newKey(t, "untrusted", nil)
+
+	k, err := ReadKeyring(strings.NewReader(armored))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, k.Len())
+
+	const data = "packet content"
+	var sig bytes.Buffer
+	assert.NoError(t, openpgp.DetachSign(&sig, trusted, strings.NewReader(data), nil))
+	assert.NoError(t, k.Verify(strings.NewReader(data), sig.Bytes()))
+	assert.Error(t, k.Verify(strings.NewReader("modified content"), sig.Bytes()))
+
+	var armoredSig bytes.Buffer
+	assert.NoError(t, openpgp.ArmoredDetachSign(&armoredSig, trusted, strings.NewReader(data), nil))
+	assert.NoError(t, k.Verify(strings.NewReader(data), armoredSig.Bytes()))
+
+	sig.Reset()
+	assert.NoError(t, openpgp.DetachSign(&sig, untrusted, strings.NewReader(data), nil))
+	assert.Error(t, k.Verify(strings.NewReader(data), sig.Bytes()))
+
+	assert.Error(t, k.Verify(strings.NewReader(data), []byte("garbage")))
+
+	_, err = ReadKeyring(strings.NewReader("no keys"))
+	assert.Error(t, err)
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	trusted, armored := newKey(t, "trusted", config)
+	untrusted, _ := newKey(t, "untrusted", config)
+
+	k, err := ReadKeyring(strings.NewReader(armored))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, k.Len())
+
+	const data = "packet content"
+	var sig bytes.Buffer
+	assert.NoError(t, openpgp.DetachSign(&sig, trusted, strings.NewReader(data), config))
+	assert.NoError(t, k.Verify(strings.NewReader(data), sig.Bytes()))
+	assert.Error(t, k.Verify(strings.NewReader("modified content"), sig.Bytes()))
+
+	sig.Reset()
+	assert.NoError(t, openpgp.DetachSign(&sig, untrusted, strings.NewReader(data), config))
+	assert.Error(t, k.Verify(strings.NewReader(data), sig.Bytes()))
+}
@@ -0,0 +1,191 @@
+// Package scheduler runs a job periodically
+package scheduler
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Options configure when a job is run
+type Options struct {
+	// Interval is the time between the starts of two runs
+	Interval time.Duration
+	// Jitter is the maximum random delay added to each scheduled run
+	Jitter time.Duration
+	// Windows restrict scheduled runs to the given times of day, runs are
+	// allowed at any time if empty
+	Windows []Window
+}
+
+// Status describes the past and next runs of a job
+type Status struct {
+	Running bool      `json:"running"`
+	LastRun time.Time `json:"last_run"`
+	// LastDuration is the duration of the last finished run in seconds
+	LastDuration float64   `json:"last_duration"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run"`
+}
+
+// Scheduler runs a job periodically. A run is skipped if the previous run is
+// still running.
+type Scheduler struct {
+	name   string
+	opts   Options
+	job    func() error
+	status Status
+	mu     sync.Mutex
+	stop   chan struct{}
+	// reschedule wakes up the loop after the options changed
+	reschedule chan struct{}
+	stopped    sync.WaitGroup
+	now        func() time.Time
+}
+
+// New creates a scheduler for the given job. The name is used for logging.
+func New(name string, opts Options, job func() error) *Scheduler {
+	return &Scheduler{
+		name:       name,
+		opts:       opts,
+		job:        job,
+		stop:       make(chan struct{}),
+		reschedule: make(chan struct{}, 1),
+		now:        time.Now,
+	}
+}
+
+// SetOptions replaces the options, the next run is rescheduled accordingly
+func (s *Scheduler) SetOptions(opts Options) {
+	s.mu.Lock()
+	s.opts = opts
+	s.mu.Unlock()
+
+	select {
+	case s.reschedule <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts scheduling runs. The first run starts right away if the
+// current time lies within a window.
+func (s *Scheduler) Start() {
+	s.stopped.Add(1)
+	go s.loop()
+}
+
+// Stop stops scheduling runs and waits for the scheduling to end. Runs that
+// are already started are not waited for.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.stopped.Wait()
+}
+
+// Trigger starts a run in the background regardless of the windows. Returns
+// false if the job is already running.
+func (s *Scheduler) Trigger() bool {
+	if !s.begin() {
+		return false
+	}
+
+	log.Println("Triggered", s.name)
+	go s.run()
+	return true
+}
+
+// Status returns the current status of the job
+func (s *Scheduler) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+// next returns the time of the next scheduled run after a run at last
+func (s *Scheduler) next(last time.Time) time.Time {
+	s.mu.Lock()
+	opts := s.opts
+	s.mu.Unlock()
+
+	t := last.Add(opts.Interval)
+	if now := s.now(); t.Before(now) {
+		t = now
+	}
+
+	t = nextInWindows(opts.Windows, t)
+	jitter := opts.Jitter
+	if left := remainingInWindows(opts.Windows, t); len(opts.Windows) > 0 && left < jitter {
+		// The jitter must not move the run out of its window
+		jitter = left
+	}
+	if jitter > 0 {
+		t = t.Add(time.Duration(rand.Int63n(int64(jitter))))
+	}
+
+	return t
+}
+
+func (s *Scheduler) loop() {
+	defer s.stopped.Done()
+
+	// Schedule the first run right away instead of after an interval
+	s.mu.Lock()
+	last := s.now().Add(-s.opts.Interval)
+	s.mu.Unlock()
+	next := s.next(last)
+	for {
+		s.mu.Lock()
+		s.status.NextRun = next
+		s.mu.Unlock()
+		log.Println("Next", s.name, "at", next.Format(time.RFC3339))
+
+		timer := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-timer.C:
+		case <-s.reschedule:
+			timer.Stop()
+			next = s.next(last)
+			continue
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		if s.begin() {
+			go s.run()
+		} else {
+			log.Println("Skipping", s.name+": still running")
+		}
+		last = next
+		next = s.next(last)
+	}
+}
+
+// begin marks the job as running, returns false if it already is
+func (s *Scheduler) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status.Running {
+		return false
+	}
+
+	s.status.Running = true
+	s.status.LastRun = s.now()
+	return true
+}
+
+// run runs the job, begin has to be called before
+func (s *Scheduler) run() {
+	err := s.job()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Running = false
+	s.status.LastDuration = s.now().Sub(s.status.LastRun).Seconds()
+	s.status.LastError = ""
+	if err != nil {
+		s.status.LastError = err.Error()
+	}
+}
@@ -0,0 +1,130 @@
+package scheduler
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduler(t *testing.T) {
+	var runs int32
+	s := New("test", Options{Interval: 20 * time.Millisecond}, func() error {
+		atomic.AddInt32(&runs, 1)
+		return errors.New("failed")
+	})
+	s.Start()
+	time.Sleep(50 * time.Millisecond)
+	s.Stop()
+	// Let the last run finish, Stop doesn't wait for it
+	time.Sleep(10 * time.Millisecond)
+
+	// Runs right away and after each interval
+	n := atomic.LoadInt32(&runs)
+	assert.True(t, n >= 2 && n <= 4, "%d runs", n)
+
+	status := s.Status()
+	assert.False(t, status.Running)
+	assert.Equal(t, "failed", status.LastError)
+	assert.False(t, status.LastRun.IsZero())
+	assert.True(t, status.NextRun.After(status.LastRun))
+}
+
+func TestSchedulerSkip(t *testing.T) {
+	release := make(chan struct{})
+	var runs int32
+	s := New("test", Options{Interval: time.Hour}, func() error {
+		atomic.AddInt32(&runs, 1)
+		<-release
+		return nil
+	})
+
+	assert.True(t, s.Trigger())
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, s.Status().Running)
+	assert.False(t, s.Trigger())
+
+	close(release)
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, s.Status().Running)
+	assert.Equal(t, "", s.Status().LastError)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+}
+
+func TestSchedulerStop(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := New("test", Options{Interval: time.Hour}, func() error {
+		<-release
+		return nil
+	})
+	s.Start()
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, s.Status().Running)
+
+	// Options are applied and the scheduling stops while a run is ongoing
+	s.SetOptions(Options{Interval: 2 * time.Hour})
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, s.Status().NextRun.After(time.Now().Add(90*time.Minute)))
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("Stop waits for the running job")
+	}
+}
+
+func TestSchedulerSetOptions(t *testing.T) {
+	var runs int32
+	s := New("test", Options{Interval: time.Hour}, func() error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	})
+	s.Start()
+	defer s.Stop()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&runs))
+	firstNext := s.Status().NextRun
+
+	// The pending run is rescheduled with the new interval
+	s.SetOptions(Options{Interval: 20 * time.Millisecond})
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&runs) >= 2)
+	assert.True(t, s.Status().NextRun.Before(firstNext))
+}
+
+func TestSchedulerNext(t *testing.T) {
+	now := at(12, 0)
+	s := New("test", Options{
+		Interval: time.Hour,
+		Jitter:   10 * time.Minute,
+		Windows:  []Window{{60, 300}},
+	}, nil)
+	s.now = func() time.Time { return now }
+
+	// Runs outside of the window are moved into it
+	next := s.next(now)
+	assert.True(t, !next.Before(at(1, 0).AddDate(0, 0, 1)) && next.Before(at(1, 10).AddDate(0, 0, 1)), next)
+
+	now = at(2, 0)
+	next = s.next(at(1, 30))
+	assert.True(t, !next.Before(at(2, 30)) && next.Before(at(2, 40)), next)
+
+	// The jitter doesn't move runs past the end of the window
+	s.opts.Jitter = 2 * time.Hour
+	for i := 0; i < 100; i++ {
+		next = s.next(at(3, 30))
+		assert.True(t, !next.Before(at(4, 30)) && next.Before(at(5, 0)), next)
+	}
+
+	// Overdue runs start right away
+	s.opts.Jitter = 0
+	assert.Equal(t, now, s.next(at(0, 0)))
+}
@@ -0,0 +1,137 @@
+package scheduler
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const minutesPerDay = 24 * 60
+
+// Window is a daily time window in local time like 01:00-05:00. Windows
+// ending before they start wrap around midnight.
+type Window struct {
+	// Start and End are given in minutes since midnight
+	Start, End int
+}
+
+var clockRegex = regexp.MustCompile(`^([0-9]{1,2}):([0-9]{2})$`)
+
+// parseClock parses a time of day given as "HH:MM" into minutes since midnight
+func parseClock(s string) (int, error) {
+	match := clockRegex.FindStringSubmatch(s)
+	if match == nil {
+		return 0, errors.Errorf(`"%s" is not a valid time of day`, s)
+	}
+
+	h, _ := strconv.Atoi(match[1])
+	m, _ := strconv.Atoi(match[2])
+	if h > 24 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.Errorf(`"%s" is not a valid time of day`, s)
+	}
+
+	return h*60 + m, nil
+}
+
+// ParseWindow parses a window given as "HH:MM-HH:MM"
+func ParseWindow(s string) (Window, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return Window{}, errors.Errorf(`"%s" is not a valid time window`, s)
+	}
+
+	start, err := parseClock(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return Window{}, err
+	}
+	end, err := parseClock(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return Window{}, err
+	}
+	if start%minutesPerDay == end%minutesPerDay {
+		return Window{}, errors.Errorf(`Time window "%s" is empty`, s)
+	}
+
+	return Window{start % minutesPerDay, end}, nil
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// minutes returns the minutes since midnight of t
+func minutes(t time.Time) int {
+	return t.Hour()*60 + t.Minute()
+}
+
+// Contains reports whether t lies within the window
+func (w Window) Contains(t time.Time) bool {
+	m := minutes(t)
+	if w.Start < w.End {
+		return m >= w.Start && m < w.End
+	}
+
+	return m >= w.Start || m < w.End
+}
+
+// Next returns t if it lies within the window, the next start of the
+// window otherwise
+func (w Window) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	y, mo, d := t.Date()
+	start := time.Date(y, mo, d, 0, w.Start, 0, 0, t.Location())
+	if !start.After(t) {
+		start = time.Date(y, mo, d+1, 0, w.Start, 0, 0, t.Location())
+	}
+
+	return start
+}
+
+// remaining returns the time left in the window from t on, t has to lie
+// within the window
+func (w Window) remaining(t time.Time) time.Duration {
+	y, mo, d := t.Date()
+	end := time.Date(y, mo, d, 0, w.End, 0, 0, t.Location())
+	if !end.After(t) {
+		end = time.Date(y, mo, d+1, 0, w.End, 0, 0, t.Location())
+	}
+
+	return end.Sub(t)
+}
+
+// remainingInWindows returns the longest time left from t on in one of the
+// windows containing t
+func remainingInWindows(windows []Window, t time.Time) time.Duration {
+	var left time.Duration
+	for _, w := range windows {
+		if r := w.remaining(t); w.Contains(t) && r > left {
+			left = r
+		}
+	}
+
+	return left
+}
+
+// nextInWindows returns the earliest time at or after t lying within one of
+// the windows, t if there are no windows
+func nextInWindows(windows []Window, t time.Time) time.Time {
+	if len(windows) == 0 {
+		return t
+	}
+
+	var next time.Time
+	for _, w := range windows {
+		if n := w.Next(t); next.IsZero() || n.Before(next) {
+			next = n
+		}
+	}
+
+	return next
+}
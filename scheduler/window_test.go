@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func at(h, m int) time.Time {
+	return time.Date(2019, 7, 10, h, m, 0, 0, time.Local)
+}
+
+func TestWindow(t *testing.T) {
+	w, err := ParseWindow("01:00-05:00")
+	assert.NoError(t, err)
+	assert.Equal(t, Window{60, 300}, w)
+	assert.Equal(t, "01:00-05:00", w.String())
+
+	assert.True(t, w.Contains(at(1, 0)))
+	assert.True(t, w.Contains(at(4, 59)))
+	assert.False(t, w.Contains(at(5, 0)))
+	assert.False(t, w.Contains(at(0, 59)))
+
+	assert.Equal(t, at(2, 30), w.Next(at(2, 30)))
+	assert.Equal(t, at(1, 0), w.Next(at(0, 10)))
+	assert.Equal(t, at(1, 0).AddDate(0, 0, 1), w.Next(at(12, 0)))
+
+	// Windows can wrap around midnight
+	w, err = ParseWindow("22:30 - 02:00")
+	assert.NoError(t, err)
+	assert.True(t, w.Contains(at(23, 0)))
+	assert.True(t, w.Contains(at(1, 0)))
+	assert.False(t, w.Contains(at(2, 0)))
+	assert.Equal(t, at(22, 30), w.Next(at(12, 0)))
+
+	w, err = ParseWindow("22:00-24:00")
+	assert.NoError(t, err)
+	assert.True(t, w.Contains(at(23, 59)))
+	assert.False(t, w.Contains(at(0, 0)))
+
+	for _, s := range []string{"", "01:00", "1-5", "25:00-01:00", "01:00-01:00", "00:00-24:00", "01:00-05:00x", "1:5-2:00"} {
+		_, err := ParseWindow(s)
+		assert.Error(t, err, s)
+	}
+
+	windows := []Window{{22 * 60, 23 * 60}, {60, 120}}
+	assert.Equal(t, at(22, 0), nextInWindows(windows, at(12, 0)))
+	assert.Equal(t, at(1, 0).AddDate(0, 0, 1), nextInWindows(windows, at(23, 0)))
+	assert.Equal(t, at(23, 0), nextInWindows(nil, at(23, 0)))
+}
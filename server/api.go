@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/veecue/pacman-smartmirror/cache"
+	"github.com/veecue/pacman-smartmirror/database"
+	"github.com/veecue/pacman-smartmirror/packet"
+)
+
+// apiError is the body of all unsuccessful API responses
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Error writing API response:", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{msg})
+}
+
+// serveAPI serves the JSON admin API. The following endpoints are available:
+//
+//	GET    /api/repos                               all known repositories and their cached packets
+//	GET    /api/downloads                           progress of all ongoing downloads
+//	DELETE /api/downloads/$arch/$repo/$file.pkg.tar.* cancel an ongoing download
+//	GET    /api/mirrors                             health of all mirrors, best first
+//	GET    /api/updates                             last and next run of the database updates
+//	POST   /api/updates                             start a database update of all repositories
+//	POST   /api/repos/$arch/$repo/refresh           force a database refresh of a repository
+//	POST   /api/packets/$arch/$repo/$file.pkg.tar.* queue a packet for prefetching
+//	DELETE /api/packets/$arch/$repo/$file.pkg.tar.* delete a packet from the cache
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request, parts []string) {
+	// All endpoints with four segments address a repository
+	if len(parts) == 4 {
+		if err := (database.Repository{Arch: parts[1], Name: parts[2]}).Validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "repos":
+		if r.Method != "GET" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.packetCache.Repos())
+
+	case len(parts) == 1 && parts[0] == "downloads":
+		if r.Method != "GET" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.packetCache.Downloads())
+
+	case len(parts) == 4 && parts[0] == "downloads":
+		if r.Method != "DELETE" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		p, err := packet.FromFilename(parts[3])
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "Invalid packet filename")
+			return
+		}
+		err = s.packetCache.CancelDownload(p, &database.Repository{
+			Arch: parts[1],
+			Name: parts[2],
+		})
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 1 && parts[0] == "mirrors":
+		if r.Method != "GET" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeJSON(w, http.StatusOK, s.packetCache.Mirrors())
+
+	case len(parts) == 1 && parts[0] == "updates":
+		s.serveAPIUpdates(w, r)
+
+	case len(parts) == 4 && parts[0] == "repos" && parts[3] == "refresh":
+		if r.Method != "POST" {
+			writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		repo := &database.Repository{
+			Arch: parts[1],
+			Name: parts[2],
+		}
+		if s.packetCache.Policy(repo).Disabled {
+			writeAPIError(w, http.StatusForbidden, "Repository disabled")
+			return
+		}
+		err := s.packetCache.RefreshRepo(repo, nil)
+		if err != nil {
+			writeAPIError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, struct{}{})
+
+	case len(parts) == 4 && parts[0] == "packets":
+		s.serveAPIPacket(w, r, &database.Repository{
+			Arch: parts[1],
+			Name: parts[2],
+		}, parts[3])
+
+	default:
+		writeAPIError(w, http.StatusNotFound, "Unknown endpoint")
+	}
+}
+
+// serveAPIUpdates handles requests to the updates endpoint of the API
+func (s *Server) serveAPIUpdates(w http.ResponseWriter, r *http.Request) {
+	if s.updates == nil {
+		writeAPIError(w, http.StatusNotFound, "Updates are not scheduled")
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, s.updates.Status())
+
+	case "POST":
+		if !s.updates.Trigger() {
+			writeAPIError(w, http.StatusConflict, "Update already running")
+			return
+		}
+		writeJSON(w, http.StatusAccepted, struct{}{})
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// serveAPIPacket handles requests to the packet endpoints of the API
+func (s *Server) serveAPIPacket(w http.ResponseWriter, r *http.Request, repo *database.Repository, filename string) {
+	p, err := packet.FromFilename(filename)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid packet filename")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		if s.packetCache.Policy(repo).Disabled {
+			writeAPIError(w, http.StatusForbidden, "Repository disabled")
+			return
+		}
+		s.packetCache.AddPacket(p, repo)
+		writeJSON(w, http.StatusAccepted, struct{}{})
+
+	case "DELETE":
+		err := s.packetCache.DeletePacket(p, repo)
+		if err == cache.ErrNotCached {
+			writeAPIError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/cache"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+	"github.com/veecue/pacman-smartmirror/scheduler"
+)
+
+const _filename = "xorg-xinit-1.4.1-1-x86_64.pkg.tar.xz"
+
+func newTestServer(t *testing.T) (*Server, string) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "x86_64", "core"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "x86_64", "core", _filename), []byte("packet"), 0644))
+
+	c, err := cache.New(dir, mirrorlist.Mirrorlist{})
+	assert.NoError(t, err)
+	return New(c), dir
+}
+
+func TestAPI(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.API().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	// The API isn't served together with the packets
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/api/repos", nil))
+	assert.Equal(t, 404, rec.Code)
+	assert.Equal(t, 404, do("GET", "/core/os/x86_64/"+_filename).Code)
+
+	rec = do("GET", "/api/repos")
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var repos []cache.RepoInfo
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &repos))
+	assert.Equal(t, 1, len(repos))
+	assert.Equal(t, "core", repos[0].Name)
+	assert.Equal(t, "x86_64", repos[0].Arch)
+	assert.Equal(t, int64(6), repos[0].Size)
+	assert.Equal(t, 1, len(repos[0].Packets))
+	assert.Equal(t, _filename, repos[0].Packets[0].Filename)
+	assert.Equal(t, "1.4.1-1", repos[0].Packets[0].Version)
+
+	rec = do("GET", "/api/downloads")
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, "[]", rec.Body.String())
+
+	rec = do("GET", "/api/mirrors")
+	assert.Equal(t, 200, rec.Code)
+	assert.JSONEq(t, "[]", rec.Body.String())
+
+	assert.Equal(t, 404, do("DELETE", "/api/downloads/x86_64/core/"+_filename).Code)
+	assert.Equal(t, 405, do("POST", "/api/repos").Code)
+	assert.Equal(t, 404, do("GET", "/api/nothing").Code)
+	assert.Equal(t, 400, do("DELETE", "/api/packets/x86_64/core/invalid").Code)
+
+	// No mirrors available to refresh from
+	assert.Equal(t, 502, do("POST", "/api/repos/x86_64/core/refresh").Code)
+
+	assert.Equal(t, 204, do("DELETE", "/api/packets/x86_64/core/"+_filename).Code)
+	assert.Equal(t, 404, do("DELETE", "/api/packets/x86_64/core/"+_filename).Code)
+	_, err := os.Stat(filepath.Join(dir, "x86_64", "core", _filename))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, http.StatusAccepted, do("POST", "/api/packets/x86_64/core/"+_filename).Code)
+
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/updates").Code)
+	release := make(chan struct{})
+	s.SetUpdateScheduler(scheduler.New("test", scheduler.Options{Interval: time.Hour}, func() error {
+		<-release
+		return nil
+	}))
+	assert.Equal(t, http.StatusAccepted, do("POST", "/api/updates").Code)
+	assert.Equal(t, http.StatusConflict, do("POST", "/api/updates").Code)
+	rec = do("GET", "/api/updates")
+	assert.Equal(t, 200, rec.Code)
+	var status scheduler.Status
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.True(t, status.Running)
+	close(release)
+
+	s.packetCache.SetPolicies(map[string]cache.Policy{"core": {Disabled: true}})
+	assert.Equal(t, http.StatusForbidden, do("POST", "/api/packets/x86_64/core/"+_filename).Code)
+	assert.Equal(t, http.StatusForbidden, do("POST", "/api/repos/x86_64/core/refresh").Code)
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/core/os/x86_64/"+_filename, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
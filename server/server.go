@@ -6,14 +6,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/veecue/pacman-smartmirror/cache"
 	"github.com/veecue/pacman-smartmirror/database"
 	"github.com/veecue/pacman-smartmirror/packet"
+	"github.com/veecue/pacman-smartmirror/scheduler"
 )
 
 // Server is an http proxy server that uses a cache
 type Server struct {
 	packetCache *cache.Cache
+	updates     *scheduler.Scheduler
+	basePath    string
 }
 
 // New will create a new Server from the given packet cache
@@ -23,74 +27,249 @@ func New(packetCache *cache.Cache) *Server {
 	}
 }
 
+// SetUpdateScheduler sets the scheduler of the database updates so it can be
+// inspected and triggered through the API
+func (s *Server) SetUpdateScheduler(updates *scheduler.Scheduler) {
+	s.updates = updates
+}
+
+// SetBasePath sets the path prefix all requests are served under, e.g. when
+// running behind a reverse proxy
+func (s *Server) SetBasePath(basePath string) {
+	s.basePath = strings.TrimSuffix("/"+strings.Trim(basePath, "/"), "/")
+}
+
+// API returns the handler of the admin API served at /api/ (see serveAPI).
+// The API manipulates the cache, so it is meant to be served on separate
+// addresses the clients of the mirror can't reach. The base path doesn't
+// apply to it.
+func (s *Server) API() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, http.StatusNotFound, "Not found")
+			return
+		}
+
+		s.serveAPI(w, r, splitPath(strings.TrimPrefix(r.URL.Path, "/api/")))
+	})
+}
+
+// splitPath splits a path into its segments, empty segments caused by
+// duplicate slashes are dropped
+func splitPath(path string) []string {
+	parts := make([]string, 0)
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	return parts
+}
+
+// writeCacheError responds with the status matching an error of the cache
+func writeCacheError(w http.ResponseWriter, filename string, err error) {
+	switch errors.Cause(err) {
+	case cache.ErrNotFound, cache.ErrOutdated:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case cache.ErrClosed:
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+	default:
+		log.Println("Error serving", filename, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
 // ServeHTTP implements the http.Server interface serving cached
 // packets and automatically retrieving missing packages from
 // the cache.
 // Requests should be in the following form:
-// /$repo/os/$arch/$file.pkg.tar.xz
+// /$repo/os/$arch/$file.pkg.tar.*
+// /$repo/os/$arch/$file.pkg.tar.*.sig
+// /$repo/os/$arch/$repo.{db,files}[.tar.gz][.sig]
 // This is how most arch upstream mirrors are called
+//
+// With the archive enabled, the same paths prefixed with /archive/YYYY/MM/DD
+// serve the databases as they were at the end of that day (UTC).
+//
+// Metrics in the Prometheus text format are served at /metrics. All paths
+// are relative to the base path.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// avoid infinite self-loopback
 	if strings.HasPrefix(r.UserAgent(), "pacman-smartmirror/") {
-		w.WriteHeader(403)
+		http.Error(w, "Requests from pacman-smartmirror are not served", http.StatusForbidden)
 		return
 	}
 
-	parts := strings.Split(r.RequestURI, "/")
-	if len(parts) != 5 {
-		http.NotFound(w, r)
+	path := r.URL.Path
+	if s.basePath != "" {
+		if !strings.HasPrefix(path, s.basePath+"/") {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		path = strings.TrimPrefix(path, s.basePath)
+	}
+
+	if path == "/metrics" {
+		s.packetCache.Metrics().ServeHTTP(w, r)
 		return
 	}
 
-	if parts[2] != "os" {
-		http.NotFound(w, r)
+	parts := splitPath(path)
+
+	// Archived databases are served as they were before the end of the day
+	var archived *time.Time
+	if len(parts) == 8 && parts[0] == "archive" {
+		if !s.packetCache.Archive().Enabled {
+			http.Error(w, "Archive disabled", http.StatusNotFound)
+			return
+		}
+
+		day, err := time.Parse("2006/01/02", strings.Join(parts[1:4], "/"))
+		if err != nil {
+			http.Error(w, "Invalid date, expected /archive/YYYY/MM/DD/", http.StatusBadRequest)
+			return
+		}
+
+		end := day.AddDate(0, 0, 1)
+		archived = &end
+		parts = parts[4:]
+	}
+
+	if len(parts) != 4 || parts[1] != "os" {
+		http.Error(w, "Not found, expected /$repo/os/$arch/$file", http.StatusNotFound)
 		return
 	}
 
 	repo := &database.Repository{
-		Name: parts[1],
-		Arch: parts[3],
+		Name: parts[0],
+		Arch: parts[2],
+	}
+	if err := repo.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	filename := parts[4]
+	if s.packetCache.Policy(repo).Disabled {
+		http.Error(w, "Repository disabled", http.StatusNotFound)
+		return
+	}
+
+	filename := parts[3]
 
-	if strings.HasSuffix(filename, ".db") {
-		if repo.Name != strings.TrimSuffix(filename, ".db") {
-			http.NotFound(w, r)
+	// Mirrors publish the databases as "$repo.db.tar.gz" with "$repo.db" as
+	// an alias, both are served from the same file
+	dbFilename := strings.TrimSuffix(filename, ".sig")
+	signature := dbFilename != filename
+	if name, artifact, ok := database.ParseArtifact(strings.TrimSuffix(dbFilename, ".tar.gz")); ok {
+		if repo.Name != name {
+			http.Error(w, "Unknown database", http.StatusNotFound)
 			return
 		}
 
-		reader, modtime, err := s.packetCache.GetDBFile(repo)
+		if archived != nil {
+			s.serveArchivedDB(w, r, filename, repo, artifact, signature, *archived)
+			return
+		}
+
+		dbFile, err := s.packetCache.GetDBFile(repo, artifact)
 		if err != nil {
 			// Proxy database directly from mirror if not in cache
-			s.packetCache.ProxyRepo(w, r, repo)
+			s.packetCache.ProxyRepo(w, r, repo, artifact, signature)
+			return
+		}
+		defer dbFile.Close()
+
+		reader := dbFile.File
+		if signature {
+			if dbFile.Signature == nil {
+				http.Error(w, "Database not signed", http.StatusNotFound)
+				return
+			}
+			reader = dbFile.Signature
+		}
+		http.ServeContent(w, r, filename, dbFile.ModTime, reader)
+		return
+	}
+
+	if strings.HasSuffix(filename, ".sig") {
+		p, err := packet.FromFilename(strings.TrimSuffix(filename, ".sig"))
+		if err != nil {
+			http.Error(w, "Unknown file", http.StatusNotFound)
+			return
+		}
+
+		reader, err := s.packetCache.GetSignature(r.Context(), p, repo)
+		if err != nil {
+			writeCacheError(w, filename, err)
 			return
 		}
 
 		defer reader.Close()
-		http.ServeContent(w, r, filename, modtime, reader)
+		http.ServeContent(w, r, filename, time.Time{}, reader)
 		return
 	}
 
 	p, err := packet.FromFilename(filename)
 	if err != nil {
-		w.WriteHeader(500)
+		http.Error(w, "Unknown file", http.StatusNotFound)
 		return
 	}
 
 	if _, ok := r.URL.Query()["bg"]; r.Method == "HEAD" && ok {
+		// Prefetch the version the repository currently has, clients may
+		// request outdated versions or other compressions
+		if index := s.packetCache.Index(repo); index != nil && index.ByFilename(filename) == nil {
+			info := index.ByName(p.Name)
+			if info == nil {
+				http.Error(w, "Packet not in database", http.StatusNotFound)
+				return
+			}
+
+			p, err = info.Packet()
+			if err != nil {
+				http.Error(w, "Invalid packet in database", http.StatusBadGateway)
+				return
+			}
+		}
+
 		s.packetCache.AddPacket(p, repo)
 		w.WriteHeader(200)
 		return
 	}
 
-	reader, err := s.packetCache.GetPacket(p, repo)
+	reader, err := s.packetCache.GetPacket(r.Context(), p, repo)
 	if err != nil {
-		log.Println("Error serving", p.Filename(), err)
-		http.NotFound(w, r)
+		writeCacheError(w, p.Filename(), err)
 		return
 	}
 
 	defer reader.Close()
 	http.ServeContent(w, r, filename, time.Time{}, reader)
 }
+
+// serveArchivedDB serves the database of a repository that was live before
+// the given time or its signature
+func (s *Server) serveArchivedDB(w http.ResponseWriter, r *http.Request, filename string, repo *database.Repository, artifact database.Artifact, signature bool, before time.Time) {
+	if artifact != database.DB {
+		http.Error(w, "Only databases are archived", http.StatusNotFound)
+		return
+	}
+
+	dbFile, err := s.packetCache.GetArchivedDBFile(repo, before)
+	if err != nil {
+		writeCacheError(w, filename, err)
+		return
+	}
+	defer dbFile.Close()
+
+	reader := dbFile.File
+	if signature {
+		if dbFile.Signature == nil {
+			http.Error(w, "Database not signed", http.StatusNotFound)
+			return
+		}
+		reader = dbFile.Signature
+	}
+	http.ServeContent(w, r, filename, dbFile.ModTime, reader)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/veecue/pacman-smartmirror/cache"
+	"github.com/veecue/pacman-smartmirror/mirrorlist"
+)
+
+func TestRouting(t *testing.T) {
+	s, dir := newTestServer(t)
+	defer os.RemoveAll(dir)
+
+	do := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	for _, path := range []string{
+		"/core/os/x86_64/" + _filename,
+		"/core/os/x86_64/" + _filename + "?foo=bar",
+		"/core//os/x86_64//" + _filename,
+		"/core/os/x86_64/xorg%2Dxinit-1.4.1-1-x86_64.pkg.tar.xz",
+	} {
+		rec := do(path)
+		assert.Equal(t, 200, rec.Code, path)
+		assert.Equal(t, "packet", rec.Body.String(), path)
+	}
+
+	for path, code := range map[string]int{
+		"/core/os/x86_64":                             404,
+		"/core/x86_64/" + _filename:                   404,
+		"/core/os/x86_64/readme.txt":                  404,
+		"/core/os/x86_64/extra.db":                    404,
+		"/../os/x86_64/" + _filename:                  400,
+		"/core/os/%2e%2e/" + _filename:                400,
+		"/core/os/x86_64/missing-1-1-any.pkg.tar.zst": 502,
+		"/api/repos":                                  404,
+	} {
+		rec := do(path)
+		assert.Equal(t, code, rec.Code, path)
+		assert.NotEmpty(t, rec.Body.String(), path)
+	}
+
+	// Packets missing on all mirrors aren't found
+	mirror := httptest.NewServer(http.NotFoundHandler())
+	defer mirror.Close()
+	s.packetCache.SetMirrors(mirrorlist.Mirrorlist{mirrorlist.Mirror(mirror.URL + "/$repo/os/$arch")})
+	assert.Equal(t, 404, do("/core/os/x86_64/missing-1-1-any.pkg.tar.zst").Code)
+
+	s.SetBasePath("/arch/")
+	assert.Equal(t, 200, do("/arch/core/os/x86_64/"+_filename).Code)
+	assert.Equal(t, 404, do("/core/os/x86_64/"+_filename).Code)
+	assert.Equal(t, 404, do("/archcore/os/x86_64/"+_filename).Code)
+
+	// Past states are only served with the archive enabled
+	assert.Equal(t, 404, do("/arch/archive/2026/10/01/core/os/x86_64/core.db").Code)
+	s.packetCache.SetArchive(cache.Archive{Enabled: true})
+	assert.Equal(t, 200, do("/arch/archive/2026/10/01/core/os/x86_64/"+_filename).Code)
+	assert.Equal(t, 404, do("/arch/archive/2026/10/01/core/os/x86_64/core.db").Code)
+	assert.Equal(t, 404, do("/arch/archive/2026/10/01/core/os/x86_64/core.files").Code)
+	assert.Equal(t, 400, do("/arch/archive/2026/13/01/core/os/x86_64/core.db").Code)
+
+	assert.NoError(t, s.packetCache.Close(context.Background()))
+	assert.Equal(t, 503, do("/arch/core/os/x86_64/missing-1-1-any.pkg.tar.zst").Code)
+}
+
+func TestDatabaseAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smartmirror-test")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// An empty database
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	assert.NoError(t, tar.NewWriter(zw).Close())
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "x86_64"), 0755))
+	filename := filepath.Join(dir, "x86_64", "core.db")
+	assert.NoError(t, ioutil.WriteFile(filename, buf.Bytes(), 0644))
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(filename, modTime, modTime))
+	assert.NoError(t, ioutil.WriteFile(filename+".sig", []byte("signature"), 0644))
+
+	c, err := cache.New(dir, mirrorlist.Mirrorlist{})
+	assert.NoError(t, err)
+	s := New(c)
+
+	for _, path := range []string{"/core/os/x86_64/core.db", "/core/os/x86_64/core.db.tar.gz"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 200, rec.Code, path)
+		assert.Equal(t, buf.Bytes(), rec.Body.Bytes(), path)
+		assert.Equal(t, modTime.Format(http.TimeFormat), rec.Header().Get("Last-Modified"), path)
+	}
+
+	for _, path := range []string{"/core/os/x86_64/core.db.sig", "/core/os/x86_64/core.db.tar.gz.sig"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 200, rec.Code, path)
+		assert.Equal(t, "signature", rec.Body.String(), path)
+	}
+
+	// Missing artifacts are proxied
+	for _, path := range []string{"/core/os/x86_64/core.files.tar.gz", "/core/os/x86_64/core.files.sig"} {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, 502, rec.Code, path)
+	}
+}
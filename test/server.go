@@ -14,6 +14,10 @@ import (
 // Callback is the function to use the HTTP Server
 type Callback func(w http.ResponseWriter, filename string, repo string, arch string)
 
+// RequestCallback is like Callback but also receives the request, e.g. to
+// inspect its headers
+type RequestCallback func(w http.ResponseWriter, r *http.Request, filename string, repo string, arch string)
+
 // Server is a simple local HTTP server listening on the given URL
 type Server struct {
 	URL    string
@@ -22,6 +26,14 @@ type Server struct {
 
 // NewServer creates a server used for testing
 func NewServer(t *testing.T, f Callback) *Server {
+	return NewRequestServer(t, func(w http.ResponseWriter, _ *http.Request, filename string, repo string, arch string) {
+		f(w, filename, repo, arch)
+	})
+}
+
+// NewRequestServer creates a server used for testing that passes the
+// request to the callback
+func NewRequestServer(t *testing.T, f RequestCallback) *Server {
 	s := &Server{}
 
 	l, err := net.Listen("tcp", "127.0.0.1:0")
@@ -45,13 +57,13 @@ func NewServer(t *testing.T, f Callback) *Server {
 
 		filename := parts[4]
 
-		if strings.HasSuffix(filename, ".db") {
+		if strings.HasSuffix(filename, ".db") || strings.HasSuffix(filename, ".files") {
 			// Ignore database files for now, maybe in the future
 			http.NotFound(w, r)
 			return
 		}
 
-		f(w, filename, repo, arch)
+		f(w, r, filename, repo, arch)
 	})
 
 	s.URL = "http://127.0.0.1:" + strconv.Itoa(port) + "/$repo/os/$arch/"